@@ -0,0 +1,53 @@
+package tredd
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+
+	"github.com/bobg/tredd/erc20"
+)
+
+// TokenAsset identifies the asset used for a payment and its collateral.
+// The zero value (a zero address) means native ETH, accounted for with
+// msg.value; any other address names an ERC-20 token contract, whose
+// transfer/transferFrom functions move funds instead.
+type TokenAsset struct {
+	Address common.Address
+}
+
+// IsNative reports whether a denotes native ETH rather than an ERC-20 token.
+func (a TokenAsset) IsNative() bool {
+	return a.Address == (common.Address{})
+}
+
+// EnsureAllowance checks owner's existing allowance for spender against a's
+// token contract and, if it is less than amount, approves spender for amount.
+// It is a no-op for native-ETH assets.
+func (a TokenAsset) EnsureAllowance(ctx context.Context, client *ethclient.Client, owner *bind.TransactOpts, spender common.Address, amount int64) error {
+	if a.IsNative() {
+		return nil
+	}
+	token, err := erc20.New(a.Address, client)
+	if err != nil {
+		return errors.Wrap(err, "binding token contract")
+	}
+	want := big.NewInt(amount)
+	have, err := token.Allowance(&bind.CallOpts{Context: ctx, From: owner.From}, owner.From, spender)
+	if err != nil {
+		return errors.Wrap(err, "checking existing allowance")
+	}
+	if have.Cmp(want) >= 0 {
+		return nil
+	}
+	tx, err := token.Approve(owner, spender, want)
+	if err != nil {
+		return errors.Wrap(err, "approving allowance")
+	}
+	_, err = bind.WaitMined(ctx, client, tx)
+	return errors.Wrap(err, "awaiting approval receipt")
+}
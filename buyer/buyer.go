@@ -0,0 +1,421 @@
+// Package buyer drives a purchase through the Tredd protocol from the
+// buyer's side: fetching a seller's cipherstream, proposing payment,
+// waiting for the key to be revealed, decrypting and verifying the
+// result, and claiming a refund if it doesn't check out.
+//
+// The design is modeled on status-go's wallet reactor/commands split: a
+// TransferManager persists one record per purchase (a Transfer) in bbolt,
+// keyed by its own transfer ID, and drives it through a state machine
+// using small idempotent commands, each safe to re-run after a crash
+// because it first checks whether its effect has already happened. An
+// async runner retries a stalled Transfer with backoff instead of
+// blocking its caller, and Resume walks the database at startup to
+// re-drive every Transfer that didn't reach a terminal state before the
+// process died.
+package buyer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/coreos/bbolt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+
+	"github.com/bobg/tredd"
+	"github.com/bobg/tredd/chainobserver"
+)
+
+// State is a Transfer's position in the purchase state machine.
+type State string
+
+// The states a Transfer passes through. Decrypted, Refunded, and Failed
+// are terminal; Resume only re-drives Transfers in the other states.
+const (
+	Requested       State = "requested"        // created locally, nothing sent yet
+	Received        State = "received"         // cipherstream fetched from the seller
+	PaymentProposed State = "payment_proposed" // payment contract deployed on-chain
+	KeyRevealed     State = "key_revealed"     // seller revealed the decryption key
+	Decrypted       State = "decrypted"        // content decrypted and verified
+	Refunded        State = "refunded"         // a root or hash mismatch was found and a refund claimed
+	Failed          State = "failed"           // given up; see Transfer.LastErr
+)
+
+func (s State) terminal() bool {
+	return s == Decrypted || s == Refunded || s == Failed
+}
+
+const transfersBucket = "transfers"
+
+// revealedBucket records, durably, which contracts m.observer has seen a
+// TreddReveal event for (see the Reveal handler registered in
+// NewTransferManager and AwaitReveal). Persisting it rather than keeping
+// it only in memory means a crash between the Observer dispatching that
+// event and AwaitReveal advancing the Transfer to KeyRevealed doesn't
+// lose track of the reveal: chainobserver's cursor advances regardless of
+// a Handler's outcome, so once a log has scrolled past it, only durable
+// state recorded by the Handler itself can recover it.
+const revealedBucket = "transfer_manager_revealed"
+
+// TransferManager persists Transfers in db and drives each through its
+// commands in its own goroutine, retrying with backoff on error.
+type TransferManager struct {
+	db         *bbolt.DB
+	client     *ethclient.Client
+	buyer      *bind.TransactOpts
+	contentDir string // where VerifyAndDecrypt writes decrypted content
+
+	observer  *chainobserver.Observer
+	scheduler *tredd.ClaimScheduler
+
+	httpClient *http.Client
+
+	mu      sync.Mutex
+	backoff map[string]time.Duration
+	running map[string]context.CancelFunc
+}
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// NewTransferManager returns a TransferManager that persists its Transfers
+// in db, pays through client as buyer, and writes decrypted content under
+// contentDir. It registers its chainobserver.Observer handlers against ctx
+// (see AwaitReveal and transferByContract); call Run, in its own
+// goroutine, to start the Observer dispatching events to them.
+func NewTransferManager(ctx context.Context, db *bbolt.DB, client *ethclient.Client, buyer *bind.TransactOpts, contentDir string) (*TransferManager, error) {
+	parsedABI, err := abi.JSON(strings.NewReader(tredd.TreddABI))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Tredd ABI")
+	}
+	observer, err := chainobserver.New(client, db, parsedABI)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating chain observer")
+	}
+
+	m := &TransferManager{
+		db:         db,
+		client:     client,
+		buyer:      buyer,
+		contentDir: contentDir,
+		observer:   observer,
+		scheduler:  tredd.NewClaimScheduler(client, db, observer),
+		httpClient: http.DefaultClient,
+		backoff:    make(map[string]time.Duration),
+		running:    make(map[string]context.CancelFunc),
+	}
+
+	m.observer.Handle(chainobserver.Reveal, func(lg types.Log) error {
+		return m.markRevealed(lg.Address)
+	})
+	m.scheduler.WatchBuyerRefunds(ctx, m.refundDeadlineOf, m.wakeByContract)
+	if err := m.scheduler.Resume(ctx, m.wakeByContract); err != nil {
+		return nil, errors.Wrap(err, "resuming pending refund watches")
+	}
+
+	return m, nil
+}
+
+// Run runs m's chainobserver.Observer until ctx is canceled, pausing
+// observerRestartInterval before restarting it whenever it returns an
+// error, so a dropped subscription recovers on its own. The Observer
+// already resubscribes itself as soon as SubmitProposePayment's
+// m.observer.Watch call adds a contract, so this loop only needs to
+// handle the failure case. Call it once, in its own goroutine, after
+// NewTransferManager.
+func (m *TransferManager) Run(ctx context.Context) {
+	for {
+		if err := m.observer.Run(ctx); err != nil {
+			log.Printf("chain observer: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(observerRestartInterval):
+		}
+	}
+}
+
+const observerRestartInterval = 30 * time.Second
+
+func (m *TransferManager) markRevealed(addr common.Address) error {
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(revealedBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating revealed-contracts bucket")
+		}
+		return bu.Put(addr.Bytes(), []byte{1})
+	})
+}
+
+func (m *TransferManager) isRevealed(addr common.Address) (bool, error) {
+	var revealed bool
+	err := m.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(revealedBucket))
+		if bu == nil {
+			return nil
+		}
+		revealed = bu.Get(addr.Bytes()) != nil
+		return nil
+	})
+	return revealed, err
+}
+
+// transferByContract finds the Transfer whose deployed contract is addr,
+// for use by the ClaimScheduler callbacks below, which only have the
+// contract address a log event named to go on.
+func (m *TransferManager) transferByContract(addr common.Address) (*Transfer, error) {
+	trs, err := m.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing transfers")
+	}
+	for _, tr := range trs {
+		if tr.ContractAddr == addr {
+			return tr, nil
+		}
+	}
+	return nil, errors.New("no transfer for contract")
+}
+
+// refundDeadlineOf and wakeByContract back m.scheduler's
+// WatchBuyerRefunds: once a watched contract's refund deadline passes
+// with no TreddReveal seen, wakeByContract re-drives that contract's
+// Transfer immediately (rather than waiting out its own backoff), which
+// is what gives a buyer that was offline through its refund window the
+// same "acts as soon as it restarts" guarantee WatchBuyerRefunds' own
+// doc comment describes: Resume (called above, in NewTransferManager)
+// recreates this wait for every contract a prior run hadn't resolved.
+func (m *TransferManager) refundDeadlineOf(addr common.Address) time.Time {
+	tr, err := m.transferByContract(addr)
+	if err != nil {
+		return time.Time{}
+	}
+	return tr.RefundDeadline
+}
+
+func (m *TransferManager) wakeByContract(addr common.Address) {
+	tr, err := m.transferByContract(addr)
+	if err != nil {
+		return
+	}
+	m.drive(context.Background(), tr.ID)
+}
+
+// StartTransfer records a new Transfer in the Requested state and begins
+// driving it in the background. It returns the transfer's ID.
+func (m *TransferManager) StartTransfer(ctx context.Context, tr *Transfer) (string, error) {
+	id, err := newTransferID()
+	if err != nil {
+		return "", errors.Wrap(err, "choosing transfer ID")
+	}
+	tr.ID = id
+	tr.State = Requested
+	tr.MismatchIndex = -1
+	tr.UpdatedAt = time.Now()
+
+	if err := m.save(tr); err != nil {
+		return "", errors.Wrap(err, "storing new transfer")
+	}
+	m.drive(ctx, tr.ID)
+	return tr.ID, nil
+}
+
+// Resume walks every Transfer in the database and re-drives the ones that
+// didn't reach a terminal state before the process last stopped. Call it
+// once at startup, after constructing the TransferManager.
+func (m *TransferManager) Resume(ctx context.Context) error {
+	var ids []string
+	err := m.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(transfersBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(k, v []byte) error {
+			var tr Transfer
+			if err := json.Unmarshal(v, &tr); err != nil {
+				return errors.Wrapf(err, "unmarshaling transfer %s", k)
+			}
+			if !tr.State.terminal() {
+				ids = append(ids, tr.ID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.Wrap(err, "scanning transfers")
+	}
+	for _, id := range ids {
+		log.Printf("resuming transfer %s", id)
+		m.drive(ctx, id)
+	}
+	return nil
+}
+
+// List returns every Transfer in the database, most-recently-updated first.
+func (m *TransferManager) List() ([]*Transfer, error) {
+	var out []*Transfer
+	err := m.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(transfersBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(_, v []byte) error {
+			var tr Transfer
+			if err := json.Unmarshal(v, &tr); err != nil {
+				return err
+			}
+			out = append(out, &tr)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing transfers")
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.After(out[j].UpdatedAt) })
+	return out, nil
+}
+
+// Get returns the Transfer with the given ID.
+func (m *TransferManager) Get(id string) (*Transfer, error) {
+	var tr Transfer
+	err := m.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(transfersBucket))
+		if bu == nil {
+			return errors.New("no such transfer")
+		}
+		v := bu.Get([]byte(id))
+		if v == nil {
+			return errors.New("no such transfer")
+		}
+		return json.Unmarshal(v, &tr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+func (m *TransferManager) save(tr *Transfer) error {
+	tr.UpdatedAt = time.Now()
+	buf, err := json.Marshal(tr)
+	if err != nil {
+		return errors.Wrap(err, "marshaling transfer")
+	}
+	return m.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(transfersBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating transfers bucket")
+		}
+		return bu.Put([]byte(tr.ID), buf)
+	})
+}
+
+// drive starts (or, if already running, leaves alone) the goroutine that
+// repeatedly advances the Transfer with the given ID until it reaches a
+// terminal state or ctx is canceled.
+func (m *TransferManager) drive(ctx context.Context, id string) {
+	m.mu.Lock()
+	if _, ok := m.running[id]; ok {
+		m.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.running[id] = cancel
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			delete(m.running, id)
+			delete(m.backoff, id)
+			m.mu.Unlock()
+		}()
+		m.run(ctx, id)
+	}()
+}
+
+func (m *TransferManager) run(ctx context.Context, id string) {
+	for {
+		tr, err := m.Get(id)
+		if err != nil {
+			log.Printf("transfer %s: %s", id, err)
+			return
+		}
+		if tr.State.terminal() {
+			return
+		}
+
+		err = m.step(ctx, tr)
+		if err == nil {
+			if err := m.save(tr); err != nil {
+				log.Printf("transfer %s: storing progress: %s", id, err)
+			}
+			m.mu.Lock()
+			delete(m.backoff, id)
+			m.mu.Unlock()
+			continue
+		}
+
+		tr.LastErr = err.Error()
+		if saveErr := m.save(tr); saveErr != nil {
+			log.Printf("transfer %s: storing error: %s", id, saveErr)
+		}
+		log.Printf("transfer %s: %s: %s", id, tr.State, err)
+
+		wait := m.nextBackoff(id)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *TransferManager) nextBackoff(id string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.backoff[id]
+	if d == 0 {
+		d = minBackoff
+	} else {
+		d *= 2
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	m.backoff[id] = d
+	return d
+}
+
+// step runs the one command that advances tr from its current state,
+// mutating it in place; the caller is responsible for persisting it.
+func (m *TransferManager) step(ctx context.Context, tr *Transfer) error {
+	switch tr.State {
+	case Requested:
+		return m.FetchCipherstream(ctx, tr)
+	case Received:
+		return m.SubmitProposePayment(ctx, tr)
+	case PaymentProposed:
+		return m.AwaitReveal(ctx, tr)
+	case KeyRevealed:
+		if tr.MismatchIndex >= 0 {
+			return m.SubmitRefund(ctx, tr)
+		}
+		return m.VerifyAndDecrypt(ctx, tr)
+	default:
+		return errors.New(fmt.Sprintf("transfer %s: no command for state %q", tr.ID, tr.State))
+	}
+}
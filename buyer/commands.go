@@ -0,0 +1,350 @@
+package buyer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/chain/txvm/protocol/bc"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/bobg/tredd"
+)
+
+// acceptTreddCipherHeader is the header a buyer sends to require a
+// specific chunk cipher from the seller; see cmd/tredd's
+// negotiateCipher, which this must agree with.
+const acceptTreddCipherHeader = "Accept-Tredd-Cipher"
+
+// FetchCipherstream downloads the cipherstream for tr from the seller,
+// saving it to a tempfile and computing its cipher root (without needing
+// the decryption key; see tredd.CipherRootOf). It is idempotent: once
+// tr.State is past Requested, it returns immediately.
+func (m *TransferManager) FetchCipherstream(ctx context.Context, tr *Transfer) error {
+	if tr.State != Requested {
+		return nil
+	}
+
+	u, err := url.Parse(tr.SellerURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing seller URL")
+	}
+	u.Path = path.Join(u.Path, "request")
+	q := u.Query()
+	q.Set("clearroot", tr.ClearRootHex)
+	q.Set("amount", strconv.FormatInt(tr.Amount, 10))
+	q.Set("assetid", hex.EncodeToString(tr.Asset.Address[:]))
+	q.Set("revealdeadline", strconv.FormatUint(bc.Millis(tr.RevealDeadline), 10))
+	q.Set("refunddeadline", strconv.FormatUint(bc.Millis(tr.RefundDeadline), 10))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set(acceptTreddCipherHeader, "aes-siv")
+	if tr.SellerTokenID != "" {
+		req.SetBasicAuth(tr.SellerTokenID, tr.SellerTokenSecret)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "fetching cipherstream")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("seller returned %s: %s", resp.Status, body)
+	}
+
+	f, err := ioutil.TempFile("", "treddbuyer")
+	if err != nil {
+		return errors.Wrap(err, "creating ciphertext tempfile")
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "saving cipherstream")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "rewinding cipherstream")
+	}
+	cipherRoot, err := tredd.CipherRootOf(f, tredd.CipherAESSIV)
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "computing cipher root")
+	}
+
+	tr.CiphertextPath = f.Name()
+	tr.CipherVersion = tredd.CipherAESSIV
+	tr.CipherRootHex = hex.EncodeToString(cipherRoot)
+	tr.SellerTransfer = resp.Header.Get("X-Tredd-Transfer-Id")
+	tr.State = Received
+	return nil
+}
+
+// proposePaymentRequest is the body SubmitProposePayment POSTs to the
+// seller's /propose-payment, naming the contract it just deployed; it must
+// match cmd/tredd's server-side proposePaymentRequest.
+type proposePaymentRequest struct {
+	ContractAddr common.Address `json:"contract_addr"`
+	Collateral   int64          `json:"collateral"`
+}
+
+// SubmitProposePayment deploys the payment contract committing to tr's
+// clear and cipher roots, deadlines, and payment terms, then tells the
+// seller its address so the seller can reveal the decryption key. It is
+// idempotent: once tr.State is past Received, it returns immediately.
+//
+// A crash between tredd.ProposePayment's receipt and the save of
+// tr.ContractAddr/tr.State would make this re-deploy a second, orphaned
+// contract on resume; tx.go's ProposePayment has no way to look up an
+// existing deployment for a given root pair, so closing that window needs
+// the same on-chain lookup tracked by its "TODO: store contractAddr".
+func (m *TransferManager) SubmitProposePayment(ctx context.Context, tr *Transfer) error {
+	if tr.State != Received {
+		return nil
+	}
+
+	clearRootBytes, err := hex.DecodeString(tr.ClearRootHex)
+	if err != nil || len(clearRootBytes) != 32 {
+		return errors.New("transfer has no valid clear root")
+	}
+	cipherRootBytes, err := hex.DecodeString(tr.CipherRootHex)
+	if err != nil || len(cipherRootBytes) != 32 {
+		return errors.New("transfer has no valid cipher root")
+	}
+	var clearRoot, cipherRoot [32]byte
+	copy(clearRoot[:], clearRootBytes)
+	copy(cipherRoot[:], cipherRootBytes)
+
+	receipt, err := tredd.ProposePayment(
+		ctx, m.client, m.buyer, tr.Seller,
+		tr.Amount, tr.Asset, tr.Collateral,
+		clearRoot, cipherRoot, tr.CipherVersion,
+		tr.RevealDeadline, tr.RefundDeadline,
+	)
+	if err != nil {
+		return errors.Wrap(err, "proposing payment")
+	}
+
+	if err := m.notifySellerOfContract(ctx, tr, receipt.ContractAddress); err != nil {
+		return errors.Wrap(err, "notifying seller of deployed contract")
+	}
+
+	if err := m.observer.Watch(receipt.ContractAddress); err != nil {
+		return errors.Wrap(err, "watching contract for reveal/refund events")
+	}
+
+	tr.ContractAddr = receipt.ContractAddress
+	tr.State = PaymentProposed
+	return nil
+}
+
+// notifySellerOfContract POSTs contractAddr to the seller's
+// /propose-payment, the signal it's waiting for before it reveals the
+// decryption key (see cmd/tredd's revealKey).
+func (m *TransferManager) notifySellerOfContract(ctx context.Context, tr *Transfer, contractAddr common.Address) error {
+	u, err := url.Parse(tr.SellerURL)
+	if err != nil {
+		return errors.Wrap(err, "parsing seller URL")
+	}
+	u.Path = path.Join(u.Path, "propose-payment")
+
+	body, err := json.Marshal(proposePaymentRequest{ContractAddr: contractAddr, Collateral: tr.Collateral})
+	if err != nil {
+		return errors.Wrap(err, "marshaling proposal")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "building request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tredd-Transfer-Id", tr.SellerTransfer)
+	if tr.SellerTokenID != "" {
+		req.SetBasicAuth(tr.SellerTokenID, tr.SellerTokenSecret)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "posting proposal")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("seller returned %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// AwaitReveal waits for m's chainobserver.Observer to see a TreddReveal
+// event for tr's contract (see the Reveal handler registered in
+// NewTransferManager, and isRevealed), rather than polling the contract
+// directly: that way a reveal the Observer saw while this transfer wasn't
+// being actively driven - including one backfilled after a process
+// restart - is still noticed the next time AwaitReveal runs. It is
+// idempotent: once tr.State is past PaymentProposed, it returns
+// immediately. Until the reveal shows up it returns an error so the
+// runner retries it with backoff; once tr.RefundDeadline has passed
+// without one, it fails the transfer outright rather than retrying
+// forever, since ClaimRefund's proof arguments are only meaningful once
+// there's a cipherstream chunk to dispute (see SubmitRefund).
+func (m *TransferManager) AwaitReveal(ctx context.Context, tr *Transfer) error {
+	if tr.State != PaymentProposed {
+		return nil
+	}
+
+	revealed, err := m.isRevealed(tr.ContractAddr)
+	if err != nil {
+		return errors.Wrap(err, "checking revealed state")
+	}
+	if !revealed {
+		if time.Now().After(tr.RefundDeadline) {
+			tr.State = Failed
+			tr.LastErr = "refund deadline passed with no key revealed; claiming a refund for a missing reveal isn't supported, see ClaimRefund's proof-format TODO in tx.go"
+			return nil
+		}
+		return errors.New("key not yet revealed")
+	}
+
+	con, err := tredd.NewTredd(tr.ContractAddr, m.client)
+	if err != nil {
+		return errors.Wrap(err, "binding deployed contract")
+	}
+	key, err := con.Key(&bind.CallOpts{Context: ctx})
+	if err != nil {
+		return errors.Wrap(err, "reading revealed key")
+	}
+
+	tr.KeyHex = hex.EncodeToString(key[:])
+	tr.State = KeyRevealed
+	return nil
+}
+
+// VerifyAndDecrypt decrypts tr's downloaded cipherstream with the
+// revealed key, writing the cleartext under the TransferManager's content
+// directory, and checks the result against tr's expected clear root. It
+// is idempotent: once tr.State is past KeyRevealed, it returns
+// immediately, and once it has recorded a chunk mismatch (see
+// tr.MismatchIndex) it isn't called again; step routes to SubmitRefund
+// instead.
+func (m *TransferManager) VerifyAndDecrypt(ctx context.Context, tr *Transfer) error {
+	if tr.State != KeyRevealed {
+		return nil
+	}
+
+	keyBytes, err := hex.DecodeString(tr.KeyHex)
+	if err != nil || len(keyBytes) != 32 {
+		return errors.New("transfer has no valid revealed key")
+	}
+	var key [32]byte
+	copy(key[:], keyBytes)
+
+	cipher, err := tredd.NewChunkCipher(tr.CipherVersion, key)
+	if err != nil {
+		return errors.Wrap(err, "building cipher")
+	}
+
+	in, err := os.Open(tr.CiphertextPath)
+	if err != nil {
+		return errors.Wrap(err, "opening cipherstream")
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(m.contentDir, 0755); err != nil {
+		return errors.Wrap(err, "creating content directory")
+	}
+	contentPath := filepath.Join(m.contentDir, tr.ID)
+	out, err := os.Create(contentPath)
+	if err != nil {
+		return errors.Wrap(err, "creating content file")
+	}
+	defer out.Close()
+
+	clearRoot, _, err := tredd.Receive(out, in, cipher)
+	if err != nil {
+		if mm, ok := err.(*tredd.ChunkMismatchError); ok {
+			tr.MismatchIndex = int64(mm.Index)
+			tr.MismatchCipherChunk = hex.EncodeToString(mm.CipherChunk)
+			tr.MismatchClearHash = hex.EncodeToString(mm.ClearHash[:])
+			return nil
+		}
+		return errors.Wrap(err, "decrypting cipherstream")
+	}
+
+	if hex.EncodeToString(clearRoot) != tr.ClearRootHex {
+		return errors.New("decrypted content's clear root does not match the expected one; this isn't a single-chunk dispute ClaimRefund can prove, failing the transfer")
+	}
+
+	tr.ContentPath = contentPath
+	tr.State = Decrypted
+	m.removeCiphertext(tr)
+	return nil
+}
+
+// SubmitRefund claims a refund for the chunk VerifyAndDecrypt found to be
+// inconsistent. It is idempotent: once tr.State is Refunded, it returns
+// immediately.
+//
+// ClaimRefund's cipherProof/clearProof parameters are an open question in
+// this codebase (see the "TODO: determine the right representation for
+// merkle proofs in Solidity" in tx.go); until that's settled, SubmitRefund
+// submits the dispute with nil proofs, which the contract is expected to
+// reject, rather than fabricate a proof encoding.
+//
+// It passes tr.CipherVersion so the contract can confirm the dispute is
+// against the same cipher the buyer actually paid for; see ClaimRefund's
+// doc comment.
+func (m *TransferManager) SubmitRefund(ctx context.Context, tr *Transfer) error {
+	if tr.State == Refunded {
+		return nil
+	}
+
+	cipherChunk, err := hex.DecodeString(tr.MismatchCipherChunk)
+	if err != nil {
+		return errors.Wrap(err, "decoding disputed cipher chunk")
+	}
+	clearHashBytes, err := hex.DecodeString(tr.MismatchClearHash)
+	if err != nil || len(clearHashBytes) != 32 {
+		return errors.Wrap(err, "decoding disputed clear hash")
+	}
+	var clearHash [32]byte
+	copy(clearHash[:], clearHashBytes)
+
+	_, err = tredd.ClaimRefund(ctx, m.client, m.buyer, tr.ContractAddr, tr.MismatchIndex, tr.CipherVersion, cipherChunk, clearHash, nil, nil)
+	if err != nil {
+		return errors.Wrap(err, "claiming refund")
+	}
+
+	tr.State = Refunded
+	m.removeCiphertext(tr)
+	return nil
+}
+
+// removeCiphertext deletes tr's downloaded ciphertext tempfile, if any, now
+// that tr has reached a terminal state and no command will read it again.
+func (m *TransferManager) removeCiphertext(tr *Transfer) {
+	if tr.CiphertextPath == "" {
+		return
+	}
+	if err := os.Remove(tr.CiphertextPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("transfer %s: removing ciphertext tempfile: %s", tr.ID, err)
+	}
+	tr.CiphertextPath = ""
+}
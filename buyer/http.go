@@ -0,0 +1,78 @@
+package buyer
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handler returns an http.Handler exposing m's transfers as JSON, for a
+// buyer CLI to mount alongside its other endpoints:
+//
+//	GET  /transfers       - list every transfer, most-recently-updated first
+//	POST /transfers       - start a new transfer; body is a Transfer with
+//	                         its StartTransfer fields set, response is
+//	                         {"id": "..."}
+//	GET  /transfers/{id}  - a single transfer's full record
+func (m *TransferManager) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transfers", m.handleTransfers)
+	mux.HandleFunc("/transfers/", m.handleGet)
+	return mux
+}
+
+func (m *TransferManager) handleTransfers(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		m.handleList(w, req)
+	case http.MethodPost:
+		m.handleStart(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (m *TransferManager) handleList(w http.ResponseWriter, req *http.Request) {
+	transfers, err := m.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, transfers)
+}
+
+func (m *TransferManager) handleStart(w http.ResponseWriter, req *http.Request) {
+	var tr Transfer
+	if err := json.NewDecoder(req.Body).Decode(&tr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := m.StartTransfer(req.Context(), &tr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]string{"id": id})
+}
+
+func (m *TransferManager) handleGet(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Path[len("/transfers/"):]
+	if id == "" {
+		http.NotFound(w, req)
+		return
+	}
+	tr, err := m.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, tr)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
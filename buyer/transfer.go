@@ -0,0 +1,75 @@
+package buyer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/bobg/tredd"
+)
+
+// Transfer is one purchase's full record: enough to resume it from any
+// non-terminal State after a crash, without talking to the seller or the
+// chain again for anything it already has.
+type Transfer struct {
+	ID string `json:"id"`
+
+	// Set by the caller of StartTransfer, before anything has happened.
+	SellerURL      string           `json:"seller_url"`
+	Seller         common.Address   `json:"seller"`
+	ClearRootHex   string           `json:"clear_root"`
+	Amount         int64            `json:"amount"`
+	Asset          tredd.TokenAsset `json:"asset"`
+	Collateral     int64            `json:"collateral"`
+	RevealDeadline time.Time        `json:"reveal_deadline"`
+	RefundDeadline time.Time        `json:"refund_deadline"`
+
+	// Set by the caller of StartTransfer: the access token this buyer
+	// authenticates to the seller with (see cmd/tredd's token subcommand).
+	// FetchCipherstream sends these as HTTP Basic credentials against the
+	// seller's /request endpoint, which requireScope rejects without them.
+	SellerTokenID     string `json:"seller_token_id,omitempty"`
+	SellerTokenSecret string `json:"seller_token_secret,omitempty"`
+
+	// Set by FetchCipherstream: the downloaded stream, the cipher version
+	// it was sent in, and the cipher-root computed from it (the value
+	// SubmitProposePayment commits to on-chain, recovered without needing
+	// the key; see tredd.CipherRootOf).
+	CiphertextPath string              `json:"ciphertext_path,omitempty"`
+	SellerTransfer string              `json:"seller_transfer_id,omitempty"`
+	CipherVersion  tredd.CipherVersion `json:"cipher_version"`
+	CipherRootHex  string              `json:"cipher_root,omitempty"`
+
+	// Set by SubmitProposePayment.
+	ContractAddr common.Address `json:"contract_addr"`
+
+	// Set by AwaitReveal.
+	KeyHex string `json:"key,omitempty"`
+
+	// Set by VerifyAndDecrypt on success.
+	ContentPath string `json:"content_path,omitempty"`
+
+	// Set by VerifyAndDecrypt when it finds a chunk whose decrypted
+	// cleartext doesn't match its committed hash; MismatchIndex is -1
+	// until then. step dispatches to SubmitRefund instead of
+	// VerifyAndDecrypt once it's set, so the claim survives a crash
+	// between detection and submission.
+	MismatchIndex       int64  `json:"mismatch_index"`
+	MismatchCipherChunk string `json:"mismatch_cipher_chunk,omitempty"`
+	MismatchClearHash   string `json:"mismatch_clear_hash,omitempty"`
+
+	State     State     `json:"state"`
+	LastErr   string    `json:"last_err,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newTransferID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, "generating transfer ID")
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
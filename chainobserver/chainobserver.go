@@ -0,0 +1,447 @@
+// Package chainobserver watches an Ethereum node for Tredd contract
+// events (TreddCreated, TreddReveal, TreddRefund, TreddPayment) and fans
+// them out to registered handlers. Unlike blocking on bind.WaitMined for
+// a single transaction, an Observer runs for the life of the process: it
+// persists a "last processed block" cursor in bbolt so that a restart
+// resumes from the correct height instead of missing events (such as a
+// refund-window expiry) that occurred while the process was down.
+//
+// A Handler's success or failure is independent of the cursor: the cursor
+// only tracks how far backfill has scanned, so it can keep advancing even
+// while a handler is failing. A failing Handler's log is instead persisted
+// to a retry queue (also in db) and retried periodically until the
+// Handler stops returning an error, so a transient failure (the seller's
+// node being unreachable when a TreddReveal arrives, say) doesn't
+// permanently drop the event the way letting the cursor skip past it would.
+package chainobserver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/coreos/bbolt"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+)
+
+// EventName enumerates the Tredd contract log events this package understands.
+type EventName string
+
+// The log events emitted by the Tredd contract.
+const (
+	Created EventName = "TreddCreated"
+	Reveal  EventName = "TreddReveal"
+	Refund  EventName = "TreddRefund"
+	Payment EventName = "TreddPayment"
+)
+
+// Handler processes one log matching a subscribed event. Returning a
+// non-nil error queues the log for retry instead of dropping it; see the
+// package doc comment.
+type Handler func(types.Log) error
+
+const (
+	cursorBucket = "chainobserver_cursor"
+	cursorKey    = "last_block"
+
+	watchBucket = "chainobserver_watched"
+
+	pendingBucket = "chainobserver_pending"
+
+	// retryInterval is how often Run retries queued failed handlers.
+	retryInterval = 2 * time.Minute
+
+	// initialBackfillRange is the number of blocks requested per FilterLogs
+	// call during backfill; it shrinks when the node rejects a range as too
+	// large and grows back toward this value as calls keep succeeding.
+	initialBackfillRange = 10000
+	minBackfillRange     = 100
+)
+
+// Observer subscribes to Tredd contract events on an Ethereum node and
+// fans them out to registered handlers, persisting its cursor in db.
+//
+// Unlike bind.WaitMined, which blocks on one expected transaction, a
+// single Observer watches every contract a caller has told it about (via
+// Watch), since Tredd deploys a fresh contract instance per transfer
+// rather than routing everything through one fixed address.
+type Observer struct {
+	client *ethclient.Client
+	db     *bbolt.DB
+	abi    abi.ABI
+
+	mu       sync.Mutex
+	watched  map[common.Address]bool
+	handlers map[EventName][]Handler
+
+	// watchedChanged is signaled (non-blockingly) by Watch so a running
+	// Run resubscribes with the updated address set instead of only
+	// noticing it the next time Run itself is restarted; see Watch and
+	// Run.
+	watchedChanged chan struct{}
+}
+
+// New creates an Observer watching client, persisting its "last processed
+// block" cursor (and watched-contract set) in db. parsedABI is the Tredd
+// contract ABI (see abi.JSON(strings.NewReader(tredd.TreddABI))), used to
+// identify which event a given log belongs to. Call Watch to add the
+// contract addresses to follow; New recovers any already persisted by a
+// prior run.
+func New(client *ethclient.Client, db *bbolt.DB, parsedABI abi.ABI) (*Observer, error) {
+	o := &Observer{
+		client:         client,
+		db:             db,
+		abi:            parsedABI,
+		watched:        make(map[common.Address]bool),
+		handlers:       make(map[EventName][]Handler),
+		watchedChanged: make(chan struct{}, 1),
+	}
+	addrs, err := o.loadWatched()
+	if err != nil {
+		return nil, errors.Wrap(err, "loading watched contracts")
+	}
+	for _, addr := range addrs {
+		o.watched[addr] = true
+	}
+	return o, nil
+}
+
+// Watch adds contract to the set of addresses this Observer follows,
+// persisting it so a restart doesn't lose track of it. It's safe to call
+// before or after Run; if Run is already subscribed, Watch wakes it up to
+// tear down and re-establish the subscription (and to backfill whatever
+// contract's already-mined events, such as the reveal that was just sent
+// when revealKey calls Watch) rather than waiting for Run to be restarted.
+func (o *Observer) Watch(contract common.Address) error {
+	o.mu.Lock()
+	o.watched[contract] = true
+	o.mu.Unlock()
+
+	if err := o.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(watchBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating watched-contracts bucket")
+		}
+		return bu.Put(contract.Bytes(), []byte{1})
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case o.watchedChanged <- struct{}{}:
+	default: // already a resubscribe pending; Run will pick up this Watch too
+	}
+	return nil
+}
+
+func (o *Observer) loadWatched() ([]common.Address, error) {
+	var addrs []common.Address
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(watchBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(k, _ []byte) error {
+			addrs = append(addrs, common.BytesToAddress(k))
+			return nil
+		})
+	})
+	return addrs, err
+}
+
+func (o *Observer) watchedAddresses() []common.Address {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	addrs := make([]common.Address, 0, len(o.watched))
+	for addr := range o.watched {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Handle registers fn to be called for every subsequent log matching name,
+// whether it's found during backfill or arrives via the live subscription.
+func (o *Observer) Handle(name EventName, fn Handler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.handlers[name] = append(o.handlers[name], fn)
+}
+
+// Run backfills from the persisted cursor (or the chain's current head, on
+// first run) up to the chain head, dispatching every matching log it finds
+// along the way, then subscribes for new logs and blocks until ctx is
+// canceled or the subscription fails. Watch can be called at any point
+// during this and Run resubscribes (after backfilling whatever the newly
+// watched contract already logged) to pick it up; callers that want to
+// keep watching across restarts, e.g. after Run itself returns an error,
+// should call Run again with a fresh ctx, which resumes from wherever the
+// cursor was left.
+func (o *Observer) Run(ctx context.Context) error {
+	if err := o.retryPending(); err != nil {
+		return errors.Wrap(err, "retrying pending events")
+	}
+
+	head, err := o.client.BlockNumber(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting chain head")
+	}
+	start, err := o.cursor()
+	if err != nil {
+		return errors.Wrap(err, "reading cursor")
+	}
+	if start == 0 {
+		start = head // first run: nothing to backfill, start watching from here
+	}
+	if err := o.backfill(ctx, start, head); err != nil {
+		return errors.Wrap(err, "backfilling")
+	}
+
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		logs, sub, err := o.subscribe(ctx)
+		if err != nil {
+			return err
+		}
+		err = o.watchLogs(ctx, logs, sub, ticker)
+		sub.Unsubscribe()
+		if err != nil {
+			return err
+		}
+		// watchLogs only returns nil when watchedChanged fired: a new
+		// contract was Watch()-ed while this subscription was live. Backfill
+		// the range it may have already logged in before we knew to watch
+		// it, then loop around to resubscribe with the updated address set.
+		head, err := o.client.BlockNumber(ctx)
+		if err != nil {
+			return errors.Wrap(err, "getting chain head")
+		}
+		cur, err := o.cursor()
+		if err != nil {
+			return errors.Wrap(err, "reading cursor")
+		}
+		if err := o.backfill(ctx, cur, head); err != nil {
+			return errors.Wrap(err, "backfilling newly watched contract")
+		}
+	}
+}
+
+// subscribe opens a live log subscription over the current watched-address
+// set.
+func (o *Observer) subscribe(ctx context.Context) (chan types.Log, ethereum.Subscription, error) {
+	logs := make(chan types.Log)
+	query := ethereum.FilterQuery{Addresses: o.watchedAddresses()}
+	sub, err := o.client.SubscribeFilterLogs(ctx, query, logs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "subscribing to logs")
+	}
+	return logs, sub, nil
+}
+
+// watchLogs dispatches logs from an established subscription until ctx is
+// canceled, the subscription fails, or watchedChanged fires, in which case
+// it returns nil so Run knows to backfill and resubscribe.
+func (o *Observer) watchLogs(ctx context.Context, logs chan types.Log, sub ethereum.Subscription, ticker *time.Ticker) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sub.Err():
+			return errors.Wrap(err, "log subscription")
+		case <-o.watchedChanged:
+			return nil
+		case lg := <-logs:
+			o.dispatch(lg)
+			if err := o.setCursor(lg.BlockNumber); err != nil {
+				return errors.Wrap(err, "updating cursor")
+			}
+		case <-ticker.C:
+			if err := o.retryPending(); err != nil {
+				log.Printf("retrying pending chainobserver events: %s", err)
+			}
+		}
+	}
+}
+
+// backfill fetches and dispatches logs in (from, to] using FilterLogs in
+// bounded block ranges, shrinking the range whenever a call errors out (as
+// RPC providers often do for ranges they consider too large) and growing
+// it back once calls succeed again.
+func (o *Observer) backfill(ctx context.Context, from, to uint64) error {
+	rangeSize := uint64(initialBackfillRange)
+	for cur := from; cur < to; {
+		end := cur + rangeSize
+		if end > to {
+			end = to
+		}
+		query := ethereum.FilterQuery{
+			Addresses: o.watchedAddresses(),
+			FromBlock: new(big.Int).SetUint64(cur + 1),
+			ToBlock:   new(big.Int).SetUint64(end),
+		}
+		logs, err := o.client.FilterLogs(ctx, query)
+		if err != nil {
+			if rangeSize > minBackfillRange {
+				rangeSize /= 2
+				continue
+			}
+			return errors.Wrapf(err, "filtering logs %d-%d", cur+1, end)
+		}
+		for _, lg := range logs {
+			o.dispatch(lg)
+		}
+		if err := o.setCursor(end); err != nil {
+			return errors.Wrap(err, "updating cursor")
+		}
+		cur = end
+		if rangeSize < initialBackfillRange {
+			rangeSize *= 2
+		}
+	}
+	return nil
+}
+
+// dispatch runs every handler registered for lg's event. The cursor
+// advances regardless of the outcome (see the package doc comment); a
+// handler that returns an error instead has lg queued for retry.
+func (o *Observer) dispatch(lg types.Log) {
+	if len(lg.Topics) == 0 {
+		return
+	}
+	ev, err := o.abi.EventByID(lg.Topics[0])
+	if err != nil {
+		return // not one of our events
+	}
+	name := EventName(ev.Name)
+
+	o.mu.Lock()
+	handlers := append([]Handler(nil), o.handlers[name]...)
+	o.mu.Unlock()
+
+	if err := o.runHandlers(name, handlers, lg); err != nil {
+		if err := o.queuePending(name, lg); err != nil {
+			log.Printf("queueing event %s for retry: %s", name, err)
+		}
+	}
+}
+
+// runHandlers calls every handler in handlers with lg, returning the first
+// error encountered (if any) after still giving every handler a chance to run.
+func (o *Observer) runHandlers(name EventName, handlers []Handler, lg types.Log) error {
+	var firstErr error
+	for _, h := range handlers {
+		if err := h(lg); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "handling %s", name)
+		}
+	}
+	return firstErr
+}
+
+// pendingEvent is the persisted form of a log a Handler failed on, kept
+// until a retry succeeds.
+type pendingEvent struct {
+	Name EventName `json:"name"`
+	Log  types.Log `json:"log"`
+}
+
+func pendingKey(lg types.Log) []byte {
+	return []byte(fmt.Sprintf("%s:%d", lg.TxHash.Hex(), lg.Index))
+}
+
+func (o *Observer) queuePending(name EventName, lg types.Log) error {
+	buf, err := json.Marshal(pendingEvent{Name: name, Log: lg})
+	if err != nil {
+		return errors.Wrap(err, "marshaling pending event")
+	}
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(pendingBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating pending-events bucket")
+		}
+		return bu.Put(pendingKey(lg), buf)
+	})
+}
+
+// retryPending re-dispatches every queued failed event, removing it from
+// the queue once every handler for it succeeds.
+func (o *Observer) retryPending() error {
+	var pending []pendingEvent
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(pendingBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(_, v []byte) error {
+			var pe pendingEvent
+			if err := json.Unmarshal(v, &pe); err != nil {
+				return errors.Wrap(err, "unmarshaling pending event")
+			}
+			pending = append(pending, pe)
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.Wrap(err, "scanning pending events")
+	}
+
+	for _, pe := range pending {
+		o.mu.Lock()
+		handlers := append([]Handler(nil), o.handlers[pe.Name]...)
+		o.mu.Unlock()
+
+		if err := o.runHandlers(pe.Name, handlers, pe.Log); err != nil {
+			continue // still failing; leave it queued
+		}
+		err := o.db.Update(func(tx *bbolt.Tx) error {
+			bu := tx.Bucket([]byte(pendingBucket))
+			if bu == nil {
+				return nil
+			}
+			return bu.Delete(pendingKey(pe.Log))
+		})
+		if err != nil {
+			log.Printf("removing retried event %s from pending queue: %s", pendingKey(pe.Log), err)
+		}
+	}
+	return nil
+}
+
+func (o *Observer) cursor() (uint64, error) {
+	var last uint64
+	err := o.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(cursorBucket))
+		if bu == nil {
+			return nil
+		}
+		v := bu.Get([]byte(cursorKey))
+		if v == nil {
+			return nil
+		}
+		last, _ = binary.Uvarint(v)
+		return nil
+	})
+	return last, err
+}
+
+func (o *Observer) setCursor(block uint64) error {
+	return o.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(cursorBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating cursor bucket")
+		}
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], block)
+		return bu.Put([]byte(cursorKey), buf[:n])
+	})
+}
@@ -0,0 +1,217 @@
+package tredd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/bobg/merkle"
+	"github.com/chain/txvm/errors"
+)
+
+// ChunkStore supplies precomputed cleartext chunks and their Merkle leaf
+// hashes to ServeFromStore, so that repeated sales of the same content
+// don't have to re-read and re-hash the source file every time.
+type ChunkStore interface {
+	// Len returns the number of chunks in the store.
+	Len() int
+
+	// ChunkAndLeafHash returns the cleartext of chunk i
+	// and the Merkle leaf hash of that chunk (prefixed with its index, as Serve computes it).
+	ChunkAndLeafHash(i int) ([]byte, [32]byte, error)
+}
+
+// FileChunkStore is a ChunkStore backed by a source file on disk.
+// It memoizes cleartext chunks and leaf hashes in two sidecar files
+// next to the source (named by the caller, conventionally <clearRoot>.chunks
+// and <clearRoot>.leaves), so that after the first build for a given source
+// the content can be served without rereading or rehashing it.
+type FileChunkStore struct {
+	numChunks int
+
+	mu         sync.Mutex
+	chunksFile *os.File
+	leavesFile *os.File
+}
+
+// NewFileChunkStore opens (building it first if necessary) a FileChunkStore
+// for the content in srcfile, memoizing chunks and leaf hashes in chunksPath
+// and leavesPath. If those sidecar files already exist and their sizes are
+// consistent with srcfile, the existing data is reused; otherwise they are
+// (re)built by reading and hashing srcfile once.
+func NewFileChunkStore(srcfile, chunksPath, leavesPath string) (*FileChunkStore, error) {
+	srcInfo, err := os.Stat(srcfile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "statting %s", srcfile)
+	}
+	numChunks := int((srcInfo.Size() + ChunkSize - 1) / ChunkSize)
+
+	if chunksInfo, err := os.Stat(chunksPath); err == nil && chunksInfo.Size() == srcInfo.Size() {
+		if leavesInfo, err := os.Stat(leavesPath); err == nil && leavesInfo.Size() == int64(numChunks*32) {
+			return openFileChunkStore(chunksPath, leavesPath, numChunks)
+		}
+	}
+
+	if err := buildChunkStoreFiles(srcfile, chunksPath, leavesPath); err != nil {
+		return nil, err
+	}
+	return openFileChunkStore(chunksPath, leavesPath, numChunks)
+}
+
+func openFileChunkStore(chunksPath, leavesPath string, numChunks int) (*FileChunkStore, error) {
+	chunksFile, err := os.OpenFile(chunksPath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", chunksPath)
+	}
+	leavesFile, err := os.OpenFile(leavesPath, os.O_RDONLY, 0)
+	if err != nil {
+		chunksFile.Close()
+		return nil, errors.Wrapf(err, "opening %s", leavesPath)
+	}
+	return &FileChunkStore{numChunks: numChunks, chunksFile: chunksFile, leavesFile: leavesFile}, nil
+}
+
+func buildChunkStoreFiles(srcfile, chunksPath, leavesPath string) error {
+	src, err := os.Open(srcfile)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", srcfile)
+	}
+	defer src.Close()
+
+	chunksFile, err := os.OpenFile(chunksPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", chunksPath)
+	}
+	defer chunksFile.Close()
+
+	leavesFile, err := os.OpenFile(leavesPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", leavesPath)
+	}
+	defer leavesFile.Close()
+
+	var (
+		hasher              = sha256.New()
+		chunk               [ChunkSize]byte
+		clearHashWithPrefix [32 + binary.MaxVarintLen64]byte
+	)
+
+	for index := uint64(0); ; index++ {
+		m := binary.PutUvarint(clearHashWithPrefix[:], index)
+
+		n, err := io.ReadFull(src, chunk[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.Wrapf(err, "reading clear chunk %d", index)
+		}
+
+		merkle.LeafHash(hasher, clearHashWithPrefix[:m], chunk[:n])
+
+		if _, err := chunksFile.Write(chunk[:n]); err != nil {
+			return errors.Wrapf(err, "writing chunk %d", index)
+		}
+		if _, err := leavesFile.Write(clearHashWithPrefix[m : m+32]); err != nil {
+			return errors.Wrapf(err, "writing leaf hash %d", index)
+		}
+
+		if n < ChunkSize {
+			break
+		}
+	}
+	return nil
+}
+
+// Len implements ChunkStore.
+func (s *FileChunkStore) Len() int {
+	return s.numChunks
+}
+
+// ChunkAndLeafHash implements ChunkStore.
+func (s *FileChunkStore) ChunkAndLeafHash(i int) ([]byte, [32]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var leafHash [32]byte
+	if _, err := s.leavesFile.ReadAt(leafHash[:], int64(i)*32); err != nil {
+		return nil, leafHash, errors.Wrapf(err, "reading leaf hash %d", i)
+	}
+
+	chunk := make([]byte, ChunkSize)
+	n, err := s.chunksFile.ReadAt(chunk, int64(i)*ChunkSize)
+	if err != nil && err != io.EOF {
+		return nil, leafHash, errors.Wrapf(err, "reading chunk %d", i)
+	}
+	return chunk[:n], leafHash, nil
+}
+
+// Close releases the FileChunkStore's open sidecar files.
+func (s *FileChunkStore) Close() error {
+	err1 := s.chunksFile.Close()
+	err2 := s.leavesFile.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+// memChunk holds one cached chunk and its leaf hash for MemChunkStore.
+type memChunk struct {
+	chunk    []byte
+	leafHash [32]byte
+}
+
+// MemChunkStore is an in-memory, LRU-bounded ChunkStore wrapping another
+// ChunkStore (typically a FileChunkStore). The first Len() call and the
+// first ChunkAndLeafHash(i) call for a given i always consult the
+// underlying store; subsequent calls for the same i are served from
+// memory until evicted.
+type MemChunkStore struct {
+	under ChunkStore
+	max   int
+
+	mu    sync.Mutex
+	cache map[int]*memChunk
+	order []int // indexes in cache, oldest first
+}
+
+// NewMemChunkStore wraps under in an in-memory cache holding at most max chunks.
+func NewMemChunkStore(under ChunkStore, max int) *MemChunkStore {
+	return &MemChunkStore{under: under, max: max, cache: make(map[int]*memChunk)}
+}
+
+// Len implements ChunkStore.
+func (s *MemChunkStore) Len() int {
+	return s.under.Len()
+}
+
+// ChunkAndLeafHash implements ChunkStore.
+func (s *MemChunkStore) ChunkAndLeafHash(i int) ([]byte, [32]byte, error) {
+	s.mu.Lock()
+	if c, ok := s.cache[i]; ok {
+		s.mu.Unlock()
+		return c.chunk, c.leafHash, nil
+	}
+	s.mu.Unlock()
+
+	chunk, leafHash, err := s.under.ChunkAndLeafHash(i)
+	if err != nil {
+		return nil, leafHash, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.cache[i]; !ok {
+		if s.max > 0 && len(s.order) >= s.max {
+			oldest := s.order[0]
+			s.order = s.order[1:]
+			delete(s.cache, oldest)
+		}
+		s.cache[i] = &memChunk{chunk: chunk, leafHash: leafHash}
+		s.order = append(s.order, i)
+	}
+	return chunk, leafHash, nil
+}
@@ -0,0 +1,155 @@
+package tredd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/chain/txvm/errors"
+	"github.com/miscreant/miscreant/go"
+)
+
+// CipherVersion identifies the chunk-encryption scheme used for a Serve
+// stream. It is written as the first byte of the stream so that a decoder
+// knows which ChunkCipher to use, and it is folded into every cipher-chunk's
+// Merkle leaf hash (as version||index||ciphertext) so a malicious seller
+// cannot downgrade a stream to a weaker cipher after the fact without it
+// showing up in the committed root.
+type CipherVersion byte
+
+const (
+	// CipherXORHash is the original cipher: a SHA-256-derived keystream XORed
+	// with the cleartext. It authenticates nothing on its own; integrity
+	// relies entirely on the outer Merkle commitment. Kept for backwards
+	// compatibility with streams produced before CipherAESSIV existed.
+	CipherXORHash CipherVersion = 0
+
+	// CipherAESSIV encrypts each chunk with AES-SIV (RFC 5297; see the
+	// miscreant package), using the chunk's varint-encoded index as
+	// associated data. Unlike CipherXORHash it is misuse-resistant
+	// authenticated encryption: tampering with a ciphertext chunk is
+	// detected on decryption, not just via the Merkle commitment.
+	CipherAESSIV CipherVersion = 1
+)
+
+// ChunkCipher encrypts and decrypts the individual chunks of a Serve wire
+// stream. Seal/Open take the chunk's index as associated data so that
+// chunks cannot be silently reordered or substituted for one another.
+type ChunkCipher interface {
+	// Version identifies this cipher on the wire; see CipherVersion.
+	Version() CipherVersion
+
+	// Overhead is the number of bytes Seal appends to a chunk beyond its
+	// cleartext length.
+	Overhead() int
+
+	// Seal appends the encryption of cleartext (the chunk at the given
+	// index) to dst and returns the extended slice.
+	Seal(dst, cleartext []byte, index uint64) ([]byte, error)
+
+	// Open appends the decryption of ciphertext (the chunk at the given
+	// index) to dst and returns the extended slice.
+	Open(dst, ciphertext []byte, index uint64) ([]byte, error)
+}
+
+// NewChunkCipher constructs the ChunkCipher named by version, keyed by key.
+func NewChunkCipher(version CipherVersion, key [32]byte) (ChunkCipher, error) {
+	switch version {
+	case CipherXORHash:
+		return newXORHashCipher(key), nil
+	case CipherAESSIV:
+		return newAESSIVCipher(key)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown cipher version %d", version))
+	}
+}
+
+// xorHashCipher is the original Serve cipher (see crypt): a keystream
+// derived from SHA-256(key, index) and XORed with the cleartext.
+type xorHashCipher struct {
+	key [32]byte
+}
+
+func newXORHashCipher(key [32]byte) *xorHashCipher {
+	return &xorHashCipher{key: key}
+}
+
+func (c *xorHashCipher) Version() CipherVersion { return CipherXORHash }
+func (c *xorHashCipher) Overhead() int          { return 0 }
+
+// crypt XORs buf in place with a keystream derived by hashing key, index,
+// and a block counter with SHA-256, taking as many 32-byte hash blocks as
+// buf needs. XOR is its own inverse, so the same function encrypts and
+// decrypts.
+func crypt(key [32]byte, buf []byte, index uint64) {
+	var indexBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(indexBuf[:], index)
+
+	for counter := uint64(0); len(buf) > 0; counter++ {
+		var counterBuf [binary.MaxVarintLen64]byte
+		cn := binary.PutUvarint(counterBuf[:], counter)
+
+		h := sha256.New()
+		h.Write(key[:])
+		h.Write(indexBuf[:n])
+		h.Write(counterBuf[:cn])
+		keystream := h.Sum(nil)
+
+		m := len(buf)
+		if m > len(keystream) {
+			m = len(keystream)
+		}
+		for i := 0; i < m; i++ {
+			buf[i] ^= keystream[i]
+		}
+		buf = buf[m:]
+	}
+}
+
+func (c *xorHashCipher) Seal(dst, cleartext []byte, index uint64) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, cleartext...)
+	crypt(c.key, dst[start:], index)
+	return dst, nil
+}
+
+func (c *xorHashCipher) Open(dst, ciphertext []byte, index uint64) ([]byte, error) {
+	// XOR is its own inverse.
+	return c.Seal(dst, ciphertext, index)
+}
+
+// aesSIVCipher encrypts each chunk with AES-SIV, authenticating the
+// chunk's index as associated data so chunks can't be reordered or
+// substituted for one another even though each is sealed independently.
+type aesSIVCipher struct {
+	aead *miscreant.Cipher
+}
+
+func newAESSIVCipher(key [32]byte) (*aesSIVCipher, error) {
+	aead, err := miscreant.NewAESCMACSIV(key[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing AES-SIV")
+	}
+	return &aesSIVCipher{aead: aead}, nil
+}
+
+func (c *aesSIVCipher) Version() CipherVersion { return CipherAESSIV }
+func (c *aesSIVCipher) Overhead() int          { return c.aead.Overhead() }
+
+func (c *aesSIVCipher) Seal(dst, cleartext []byte, index uint64) ([]byte, error) {
+	ad := indexBytes(index)
+	out, err := c.aead.Seal(dst, cleartext, ad)
+	return out, errors.Wrap(err, "sealing chunk")
+}
+
+func (c *aesSIVCipher) Open(dst, ciphertext []byte, index uint64) ([]byte, error) {
+	ad := indexBytes(index)
+	out, err := c.aead.Open(dst, ciphertext, ad)
+	return out, errors.Wrap(err, "opening chunk")
+}
+
+func indexBytes(index uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], index)
+	return buf[:n]
+}
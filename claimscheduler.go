@@ -0,0 +1,185 @@
+package tredd
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+
+	"github.com/bobg/tredd/chainobserver"
+)
+
+// ClaimScheduler drives ClaimPayment and ClaimRefund from chainobserver
+// events rather than sleeping on wall-clock deadlines against a single
+// in-memory transaction, so a seller or buyer that was offline through a
+// refund window still acts on every pending contract as soon as its
+// Observer resumes and backfills the events it missed.
+type ClaimScheduler struct {
+	client *ethclient.Client
+	db     *bbolt.DB
+	o      *chainobserver.Observer
+}
+
+const pendingRefundBucket = "claimscheduler_pending_refunds"
+
+// NewClaimScheduler returns a ClaimScheduler that registers handlers on o,
+// persisting its own state (pending refund watches) in db. Call o.Run
+// separately (typically in its own goroutine) to start dispatching the
+// events that drive it.
+func NewClaimScheduler(client *ethclient.Client, db *bbolt.DB, o *chainobserver.Observer) *ClaimScheduler {
+	return &ClaimScheduler{client: client, db: db, o: o}
+}
+
+// WatchSellerClaims calls ClaimPayment (as opts) for every TreddReveal
+// event the Observer sees, whether it arrives live or turns up during
+// backfill after a restart. onErr, if non-nil, is called with any error
+// from an individual claim, in addition to the error being returned to the
+// Observer so it can queue the event for retry (see chainobserver's
+// pending-event queue).
+func (s *ClaimScheduler) WatchSellerClaims(ctx context.Context, opts *bind.TransactOpts, onErr func(contractAddr common.Address, err error)) {
+	s.o.Handle(chainobserver.Reveal, func(lg types.Log) error {
+		_, err := ClaimPayment(ctx, s.client, opts, lg.Address)
+		if err != nil {
+			if onErr != nil {
+				onErr(lg.Address, err)
+			}
+			return errors.Wrapf(err, "claiming payment for %s", lg.Address)
+		}
+		return nil
+	})
+}
+
+// pendingRefund is the persisted record of a contract WatchBuyerRefunds is
+// waiting out the refund deadline for, so a crash between a TreddCreated
+// event being observed and its deadline goroutine being (re-)created
+// doesn't silently drop the watch: chainobserver's cursor only guarantees
+// backfill won't replay an already-processed Created event, so the
+// in-memory state built from that event has to be durable on its own.
+type pendingRefund struct {
+	DeadlineUnixNano int64 `json:"deadline_unix_nano"`
+}
+
+// WatchBuyerRefunds calls fn for every Tredd contract whose refund
+// deadline (as returned by refundDeadline) passes without a TreddReveal
+// event having been observed for it. ClaimRefund itself needs ciphertext
+// and Merkle proof data that isn't present in the log, so fn is
+// responsible for assembling that data and calling ClaimRefund; this only
+// decides when a refund claim is due.
+//
+// Call Resume once at startup, after calling WatchBuyerRefunds, to
+// recreate the deadline watches for any contract a prior run of this
+// process saw TreddCreated for but hadn't yet resolved.
+func (s *ClaimScheduler) WatchBuyerRefunds(ctx context.Context, refundDeadline func(contractAddr common.Address) time.Time, fn func(contractAddr common.Address)) {
+	var (
+		mu       sync.Mutex
+		revealed = make(map[common.Address]bool)
+	)
+
+	s.o.Handle(chainobserver.Reveal, func(lg types.Log) error {
+		mu.Lock()
+		revealed[lg.Address] = true
+		mu.Unlock()
+		if err := s.clearPendingRefund(lg.Address); err != nil {
+			return errors.Wrap(err, "clearing pending refund watch")
+		}
+		return nil
+	})
+
+	watch := func(contractAddr common.Address, deadline time.Time) {
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(deadline)):
+			}
+			mu.Lock()
+			wasRevealed := revealed[contractAddr]
+			mu.Unlock()
+			if !wasRevealed {
+				fn(contractAddr)
+			}
+		}()
+	}
+
+	s.o.Handle(chainobserver.Created, func(lg types.Log) error {
+		contractAddr := lg.Address
+		deadline := refundDeadline(contractAddr)
+		if err := s.putPendingRefund(contractAddr, deadline); err != nil {
+			return errors.Wrap(err, "persisting pending refund watch")
+		}
+		watch(contractAddr, deadline)
+		return nil
+	})
+}
+
+// Resume recreates the deadline watch for every contract persisted by
+// WatchBuyerRefunds that hasn't since been cleared by a TreddReveal. Call
+// it once at startup, after WatchBuyerRefunds has registered its handlers.
+func (s *ClaimScheduler) Resume(ctx context.Context, fn func(contractAddr common.Address)) error {
+	pending, err := s.loadPendingRefunds()
+	if err != nil {
+		return errors.Wrap(err, "loading pending refund watches")
+	}
+	for addr, deadline := range pending {
+		contractAddr, d := addr, deadline
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(d)):
+			}
+			fn(contractAddr)
+		}()
+	}
+	return nil
+}
+
+func (s *ClaimScheduler) putPendingRefund(contractAddr common.Address, deadline time.Time) error {
+	buf, err := json.Marshal(pendingRefund{DeadlineUnixNano: deadline.UnixNano()})
+	if err != nil {
+		return errors.Wrap(err, "marshaling pending refund")
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(pendingRefundBucket))
+		if err != nil {
+			return errors.Wrap(err, "creating pending-refunds bucket")
+		}
+		return bu.Put(contractAddr.Bytes(), buf)
+	})
+}
+
+func (s *ClaimScheduler) clearPendingRefund(contractAddr common.Address) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(pendingRefundBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.Delete(contractAddr.Bytes())
+	})
+}
+
+func (s *ClaimScheduler) loadPendingRefunds() (map[common.Address]time.Time, error) {
+	pending := make(map[common.Address]time.Time)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(pendingRefundBucket))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(k, v []byte) error {
+			var pr pendingRefund
+			if err := json.Unmarshal(v, &pr); err != nil {
+				return errors.Wrap(err, "unmarshaling pending refund")
+			}
+			pending[common.BytesToAddress(k)] = time.Unix(0, pr.DeadlineUnixNano)
+			return nil
+		})
+	})
+	return pending, err
+}
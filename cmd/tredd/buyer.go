@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/bobg/tredd/buyer"
+	"github.com/chain/txvm/errors"
+	"github.com/coreos/bbolt"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// buy starts a buyer process: it resumes any in-flight transfers recorded
+// in its db, then serves an HTTP/JSON API (see buyer.TransferManager.Handler)
+// so an external UI can start, list, and query them.
+func buy(args []string) {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	var (
+		addr       = fs.String("addr", "localhost:20545", "buyer API listen address")
+		dbFile     = fs.String("db", "", "file containing buyer-state db")
+		prvFile    = fs.String("prv", "", "file containing buyer's Ethereum private key, hex-encoded")
+		url        = fs.String("url", "", "URL of Ethereum JSON-RPC server")
+		contentDir = fs.String("content-dir", ".", "directory to write decrypted content to")
+	)
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := ethclient.Dial(*url)
+	if err != nil {
+		log.Fatalf("dialing %s: %s", *url, err)
+	}
+
+	prv, err := loadECDSAKeyFile(*prvFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		log.Fatalf("getting chain ID: %s", err)
+	}
+	opts := newKeyedTransactor(prv, chainID)
+
+	db, err := bbolt.Open(*dbFile, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	mgr, err := buyer.NewTransferManager(ctx, db, client, opts, *contentDir)
+	if err != nil {
+		log.Fatalf("creating transfer manager: %s", err)
+	}
+	go mgr.Run(ctx)
+
+	if err := mgr.Resume(ctx); err != nil {
+		log.Fatalf("resuming transfers: %s", err)
+	}
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mgr.Handler()))
+}
+
+// loadECDSAKeyFile reads a hex-encoded secp256k1 private key from path,
+// the same format produced by `geth account` key exports.
+func loadECDSAKeyFile(path string) (*ecdsa.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading key file")
+	}
+	prv, err := crypto.HexToECDSA(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing private key")
+	}
+	return prv, nil
+}
+
+// newKeyedTransactor builds a *bind.TransactOpts that signs with prv using
+// an EIP-155 signer bound to chainID. The go-ethereum version this module
+// is pinned to doesn't yet have bind.NewKeyedTransactorWithChainID, so this
+// reimplements it directly against types.NewEIP155Signer.
+func newKeyedTransactor(prv *ecdsa.PrivateKey, chainID *big.Int) *bind.TransactOpts {
+	keyAddr := crypto.PubkeyToAddress(prv.PublicKey)
+	signer := types.NewEIP155Signer(chainID)
+	return &bind.TransactOpts{
+		From: keyAddr,
+		Signer: func(s types.Signer, address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != keyAddr {
+				return nil, errors.New("not authorized to sign this account")
+			}
+			sig, err := crypto.Sign(signer.Hash(tx).Bytes(), prv)
+			if err != nil {
+				return nil, err
+			}
+			return tx.WithSignature(signer, sig)
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bobg/tredd"
+)
+
+// genVectors regenerates the Serve conformance corpus in testvectors/,
+// covering the edge cases TestServeConformance (in the tredd package)
+// checks against: empty input, a single byte, exactly one chunk, one
+// chunk plus a byte, several full chunks, a short final chunk, and both
+// an all-zero and an all-0xFF key - for both ChunkCipher implementations,
+// so a reimplementation of either CipherXORHash or CipherAESSIV has
+// vectors to validate against.
+func genVectors(args []string) {
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	dir := fs.String("dir", "testvectors", "directory to write generated vector files into")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	var allFF [32]byte
+	for i := range allFF {
+		allFF[i] = 0xff
+	}
+	keys := []struct {
+		name string
+		key  [32]byte
+	}{
+		{"zero-key", [32]byte{}},
+		{"ff-key", allFF},
+	}
+
+	cases := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", nil},
+		{"one-byte", []byte{0x2a}},
+		{"one-chunk", bytes.Repeat([]byte{0x01}, tredd.ChunkSize)},
+		{"one-chunk-plus-one", bytes.Repeat([]byte{0x02}, tredd.ChunkSize+1)},
+		{"multi-chunk", bytes.Repeat([]byte{0x03}, 3*tredd.ChunkSize)},
+		{"short-final-chunk", append(bytes.Repeat([]byte{0x04}, 2*tredd.ChunkSize), 0x05, 0x06, 0x07)},
+	}
+
+	ciphers := []struct {
+		name    string
+		version tredd.CipherVersion
+	}{
+		{"xorhash", tredd.CipherXORHash},
+		{"aessiv", tredd.CipherAESSIV},
+	}
+
+	for _, cp := range ciphers {
+		for _, c := range cases {
+			for _, k := range keys {
+				name := fmt.Sprintf("%s-%s-%s", c.name, k.name, cp.name)
+				vs, err := tredd.GenerateVectorSet(name, c.content, k.key, cp.version)
+				if err != nil {
+					log.Fatalf("generating %s: %s", name, err)
+				}
+				buf, err := json.MarshalIndent(vs, "", "  ")
+				if err != nil {
+					log.Fatalf("marshaling %s: %s", name, err)
+				}
+				path := filepath.Join(*dir, name+".json")
+				if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+					log.Fatalf("writing %s: %s", path, err)
+				}
+				log.Printf("wrote %s", path)
+			}
+		}
+	}
+}
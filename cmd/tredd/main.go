@@ -0,0 +1,29 @@
+// Command tredd implements the buyer and seller sides of a Tredd transfer,
+// plus supporting subcommands for access-token management and test-vector
+// generation.
+package main
+
+import (
+	"log"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: tredd <serve|buy|token|gen-vectors> ...")
+	}
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "serve":
+		serve(args)
+	case "buy":
+		buy(args)
+	case "token":
+		token(args)
+	case "gen-vectors":
+		genVectors(args)
+	default:
+		log.Fatalf("unknown subcommand %q", os.Args[1])
+	}
+}
@@ -3,64 +3,80 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"math"
 	"net"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/bobg/tredd"
-	"github.com/chain/txvm/crypto/ed25519"
-	"github.com/chain/txvm/errors"
 	"github.com/chain/txvm/protocol/bc"
-	"github.com/chain/txvm/protocol/txvm"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+
 	"github.com/coreos/bbolt"
+
+	"github.com/bobg/tredd"
+	"github.com/bobg/tredd/chainobserver"
 )
 
+// observerRestartInterval is the pause runObserver takes before calling
+// s.observer.Run again after it returns an error (a dropped subscription,
+// say); Run itself already resubscribes immediately whenever
+// s.observer.Watch (see revealKey) adds a contract mid-run, so this is
+// only a failure-recovery backoff, not a periodic resubscribe.
+const observerRestartInterval = 30 * time.Second
+
+// serve starts a seller process: it serves an HTTP API for buyers to
+// fetch cipherstreams and propose payment on-chain, then reveals the
+// decryption key once a buyer names its deployed contract and claims
+// payment for it once its ClaimScheduler reacts to the mined reveal (see
+// runObserver, claimscheduler.go).
 func serve(args []string) {
 	ctx := context.Background()
 
 	fs := flag.NewFlagSet("", flag.PanicOnError)
 
 	var (
-		addr    = fs.String("addr", "localhost:20544", "server listen address")
-		dir     = fs.String("dir", ".", "root of content tree")
-		dbFile  = fs.String("db", "", "file containing server-state db")
-		prvFile = fs.String("prv", "", "file containing server private key")
-		url     = fs.String("url", "", "URL of blockchain server")
+		addr      = fs.String("addr", "localhost:20544", "server listen address")
+		dir       = fs.String("dir", ".", "root of content tree")
+		dbFile    = fs.String("db", "", "file containing server-state db")
+		prvFile   = fs.String("prv", "", "file containing server's Ethereum private key, hex-encoded")
+		url       = fs.String("url", "", "URL of Ethereum JSON-RPC server")
+		minPrices = fs.String("min-prices", "", "comma-separated assetid:amount minimum prices, e.g. 0000...0000:10,<erc20addr>:500; assets not listed default to a minimum of 1")
 	)
 
-	err := fs.Parse(args)
-	if err != nil {
+	if err := fs.Parse(args); err != nil {
 		log.Fatal(err)
 	}
 
-	submitURL := *url + "/submit"
-	getURL := *url + "/get"
-
-	f, err := os.Open(*prvFile)
+	client, err := ethclient.Dial(*url)
 	if err != nil {
-		log.Fatalf("opening prv file %s: %s", *prvFile, err)
+		log.Fatalf("dialing %s: %s", *url, err)
 	}
-	defer f.Close()
 
-	var prvbuf [ed25519.PrivateKeySize]byte
-	_, err = io.ReadFull(f, prvbuf[:])
+	prv, err := loadECDSAKeyFile(*prvFile)
 	if err != nil {
-		log.Fatalf("reading prv file %s: %s", *prvFile, err)
+		log.Fatal(err)
 	}
-	f.Close()
-
-	prv := ed25519.PrivateKey(prvbuf[:])
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		log.Fatalf("getting chain ID: %s", err)
+	}
+	seller := newKeyedTransactor(prv, chainID)
 
 	db, err := bbolt.Open(*dbFile, 0600, nil)
 	if err != nil {
@@ -68,46 +84,38 @@ func serve(args []string) {
 	}
 	defer db.Close()
 
-	seller := prv.Public().(ed25519.PublicKey)
-	s := &server{
-		db:     db,
-		dir:    *dir,
-		seller: seller,
-		o:      newObserver(db, seller, getURL),
-	}
-	s.signer = func(msg []byte) ([]byte, error) {
-		return ed25519.Sign(prv, msg), nil
+	parsedPrices, err := parseMinPrices(*minPrices)
+	if err != nil {
+		log.Fatalf("parsing -min-prices: %s", err)
 	}
-	s.submitter = submitter(submitURL)
 
-	var transferIDs [][]byte
-	err = db.View(func(tx *bbolt.Tx) error {
-		root := tx.Bucket([]byte("root"))
-		if root == nil {
-			return nil
-		}
-		recordsBucket := root.Bucket([]byte("records"))
-		if recordsBucket == nil {
-			return nil
-		}
-		return recordsBucket.ForEach(func(transferID, _ []byte) error {
-			transferIDs = append(transferIDs, transferID)
-			return nil
-		})
-	})
+	parsedABI, err := abi.JSON(strings.NewReader(tredd.TreddABI))
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("parsing Tredd ABI: %s", err)
 	}
-	for _, transferID := range transferIDs {
-		log.Printf("queueing claim-payment callback for transfer %x", transferID)
-		err = s.queueClaimPayment(transferID)
-		if err != nil {
-			log.Fatal(err)
-		}
+	observer, err := chainobserver.New(client, db, parsedABI)
+	if err != nil {
+		log.Fatalf("creating chain observer: %s", err)
+	}
+	scheduler := tredd.NewClaimScheduler(client, db, observer)
+	scheduler.WatchSellerClaims(ctx, seller, func(contractAddr common.Address, err error) {
+		log.Printf("claiming payment for contract %s: %s", contractAddr, err)
+	})
+
+	s := &server{
+		db:          db,
+		dir:         *dir,
+		client:      client,
+		seller:      seller,
+		minPrices:   parsedPrices,
+		chunkStores: make(map[string]*tredd.FileChunkStore),
+		observer:    observer,
+		scheduler:   scheduler,
 	}
 
-	log.Print("starting blockchain observer")
-	go s.o.run(ctx)
+	log.Print("warming chunk stores")
+	go s.warmChunkStores()
+	go s.runObserver(ctx)
 
 	listener, err := net.Listen("tcp", *addr)
 	if err != nil {
@@ -116,23 +124,89 @@ func serve(args []string) {
 
 	log.Printf("listening on %s", listener.Addr())
 
-	http.HandleFunc("/request", s.serve)
-	http.HandleFunc("/propose-payment", s.revealKey)
-	http.Serve(listener, nil)
+	http.HandleFunc("/request", s.requireScope(scopeRequest, s.serve))
+	http.HandleFunc("/propose-payment", s.requireScope(scopeProposePayment, s.revealKey))
+	log.Fatal(http.Serve(listener, nil))
+}
+
+// parseMinPrices parses the -min-prices flag: a comma-separated list of
+// <hex assetID>:<amount> pairs, into the map s.minPrices expects. An empty
+// string yields a nil map, meaning every asset falls back to checkPrice's
+// default minimum of 1.
+func parseMinPrices(s string) (map[string]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	out := make(map[string]int64)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed entry %q, want assetid:amount", pair)
+		}
+		assetID, err := hex.DecodeString(parts[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding asset ID %q", parts[0])
+		}
+		amount, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing amount %q", parts[1])
+		}
+		out[hex.EncodeToString(assetID)] = amount
+	}
+	return out, nil
 }
 
 type server struct {
-	db        *bbolt.DB // transfer records and blockchain info
-	dir       string    // content
-	seller    ed25519.PublicKey
-	o         *observer
-	signer    tredd.Signer
-	submitter func(prog []byte, version, runlimit int64) error
+	db     *bbolt.DB // pending transfer records
+	dir    string    // content
+	client *ethclient.Client
+	seller *bind.TransactOpts
+
+	observer  *chainobserver.Observer
+	scheduler *tredd.ClaimScheduler
+
+	minPrices map[string]int64 // hex-encoded assetID -> minimum acceptable amount; missing entries fall back to 1
+
+	chunkStoresMu sync.Mutex
+	chunkStores   map[string]*tredd.FileChunkStore // clearRoot (hex) -> store
 }
 
+// runObserver runs s.observer until ctx is canceled, pausing
+// observerRestartInterval before restarting it whenever it returns an
+// error, so a dropped subscription recovers on its own. s.observer.Run
+// already resubscribes itself as soon as revealKey's s.observer.Watch call
+// adds a contract, so this loop only needs to handle the failure case.
+func (s *server) runObserver(ctx context.Context) {
+	for {
+		if err := s.observer.Run(ctx); err != nil {
+			log.Printf("chain observer: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(observerRestartInterval):
+		}
+	}
+}
+
+// serverRecord is one pending sale's state: everything serve (the /request
+// handler) commits to before a contract exists, plus the fields revealKey
+// fills in once the buyer reports the contract it deployed.
 type serverRecord struct {
-	tredd.ParseResult
 	transferID [32]byte
+
+	ClearRoot      []byte
+	CipherRoot     []byte
+	CipherVersion  tredd.CipherVersion
+	Asset          tredd.TokenAsset
+	Amount         int64
+	RevealDeadline time.Time
+	RefundDeadline time.Time
+	Key            []byte
+
+	// Set by revealKey, once the buyer's proposal names the deployed contract.
+	ContractAddr common.Address
+	Collateral   int64
 }
 
 const (
@@ -156,16 +230,17 @@ func (s *server) serve(w http.ResponseWriter, req *http.Request) {
 	}
 
 	dir, filename := clearHashPath(s.dir, clearRoot)
-	f, err := os.Open(path.Join(dir, filename))
-	if os.IsNotExist(err) {
+	srcfile := path.Join(dir, filename)
+	if _, err := os.Stat(srcfile); os.IsNotExist(err) {
 		httpErrf(w, http.StatusNotFound, "file not found")
 		return
 	}
+
+	store, err := s.chunkStoreFor(srcfile, clearRoot)
 	if err != nil {
 		httpErrf(w, http.StatusInternalServerError, "opening %s: %s", filename, err)
 		return
 	}
-	defer f.Close()
 
 	contentType, err := ioutil.ReadFile(path.Join(dir, "content-type"))
 	if err != nil {
@@ -182,14 +257,19 @@ func (s *server) serve(w http.ResponseWriter, req *http.Request) {
 		httpErrf(w, http.StatusBadRequest, "non-positive amount %d", amount)
 		return
 	}
-	assetID, err := hex.DecodeString(assetIDStr)
+	assetIDBytes, err := hex.DecodeString(assetIDStr)
 	if err != nil {
 		httpErrf(w, http.StatusBadRequest, "parsing asset ID: %s", err)
 		return
 	}
+	if len(assetIDBytes) != common.AddressLength {
+		httpErrf(w, http.StatusBadRequest, "asset ID must be %d bytes, got %d", common.AddressLength, len(assetIDBytes))
+		return
+	}
+	asset := tredd.TokenAsset{Address: common.BytesToAddress(assetIDBytes)}
 
-	err = s.checkPrice(amount, assetID, clearRoot)
-	if err != nil {
+	tokenID := tokenIDFromContext(req.Context())
+	if err := s.checkPrice(amount, assetIDBytes, clearRoot, tokenID); err != nil {
 		httpErrf(w, http.StatusBadRequest, "proposed payment rejected: %s", err)
 		return
 	}
@@ -219,31 +299,37 @@ func (s *server) serve(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var key [32]byte
-	_, err = rand.Read(key[:])
-	if err != nil {
+	if _, err := rand.Read(key[:]); err != nil {
 		httpErrf(w, http.StatusInternalServerError, "choosing cipher key: %s", err)
 		return
 	}
 
 	rec := &serverRecord{
-		ParseResult: tredd.ParseResult{
-			Amount:         amount,
-			AssetID:        assetID,
-			ClearRoot:      clearRoot,
-			RevealDeadline: revealDeadline,
-			RefundDeadline: refundDeadline,
-			Seller:         s.seller,
-			Key:            key[:],
-		},
-	}
-
-	_, err = rand.Read(rec.transferID[:])
-	if err != nil {
+		ClearRoot:      clearRoot,
+		Asset:          asset,
+		Amount:         amount,
+		RevealDeadline: revealDeadline,
+		RefundDeadline: refundDeadline,
+		Key:            key[:],
+	}
+	if _, err := rand.Read(rec.transferID[:]); err != nil {
 		httpErrf(w, http.StatusInternalServerError, "choosing transfer ID: %s", err)
 		return
 	}
 
-	log.Printf("new transfer %x, clearRoot %x, payment %d/%x, deadlines %s/%s, key %x", rec.transferID[:], clearRoot, amount, assetID, revealDeadline, refundDeadline, key[:])
+	log.Printf("new transfer %x, clearRoot %x, payment %d/%x, deadlines %s/%s, key %x", rec.transferID[:], clearRoot, amount, assetIDBytes, revealDeadline, refundDeadline, key[:])
+
+	cipherVersion, err := negotiateCipher(req)
+	if err != nil {
+		httpErrf(w, http.StatusBadRequest, "negotiating cipher: %s", err)
+		return
+	}
+	cipher, err := tredd.NewChunkCipher(cipherVersion, key)
+	if err != nil {
+		httpErrf(w, http.StatusInternalServerError, "building cipher: %s", err)
+		return
+	}
+	rec.CipherVersion = cipherVersion
 
 	w.Header().Set("X-Tredd-Transfer-Id", hex.EncodeToString(rec.transferID[:]))
 	w.Header().Set("Content-Type", string(contentType))
@@ -257,22 +343,20 @@ func (s *server) serve(w http.ResponseWriter, req *http.Request) {
 	defer os.Remove(tmpfilename)
 	defer tmpfile.Close()
 
-	cipherRoot, err := tredd.Serve(tmpfile, f, key)
+	cipherRoot, err := tredd.ServeFromStore(tmpfile, store, cipher)
 	if err != nil {
 		httpErrf(w, http.StatusInternalServerError, "serving data: %s", err)
 		return
 	}
 
-	err = tmpfile.Close()
-	if err != nil {
+	if err := tmpfile.Close(); err != nil {
 		httpErrf(w, http.StatusInternalServerError, "closing response tempfile: %s", err)
 		return
 	}
 
 	rec.CipherRoot = cipherRoot
 
-	err = s.storeRecord(rec)
-	if err != nil {
+	if err := s.storeRecord(rec); err != nil {
 		httpErrf(w, http.StatusInternalServerError, "storing transfer record: %s", err)
 		return
 	}
@@ -283,18 +367,29 @@ func (s *server) serve(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	defer tmpfile.Close()
-	_, err = io.Copy(w, tmpfile)
-	if err != nil {
+	if _, err := io.Copy(w, tmpfile); err != nil {
 		httpErrf(w, http.StatusInternalServerError, "writing response: %s", err)
 		return
 	}
 }
 
+// proposePaymentRequest is the body a buyer POSTs to /propose-payment once
+// it has deployed a Tredd contract for the transfer named by its
+// X-Tredd-Transfer-Id header (see buyer.TransferManager.SubmitProposePayment).
+type proposePaymentRequest struct {
+	ContractAddr common.Address `json:"contract_addr"`
+	Collateral   int64          `json:"collateral"`
+}
+
+// revealKey trusts the buyer's claimed contractAddr and collateral as-is;
+// it does not yet check the deployed contract's committed terms against
+// rec before revealing the key and staking collateral against it. See
+// tx.go's RevealKey TODO to read back and verify the on-chain values.
 func (s *server) revealKey(w http.ResponseWriter, req *http.Request) {
 	transferIDStr := req.Header.Get("X-Tredd-Transfer-Id")
 
-	paymentProposal, err := ioutil.ReadAll(req.Body)
-	if err != nil {
+	var proposal proposePaymentRequest
+	if err := json.NewDecoder(req.Body).Decode(&proposal); err != nil {
 		httpErrf(w, http.StatusBadRequest, "reading payment proposal: %s", err)
 		return
 	}
@@ -310,57 +405,51 @@ func (s *server) revealKey(w http.ResponseWriter, req *http.Request) {
 		httpErrf(w, http.StatusInternalServerError, "finding transfer record: %s", err)
 		return
 	}
+	rec.ContractAddr = proposal.ContractAddr
+	rec.Collateral = proposal.Collateral
+
+	if tokenID := tokenIDFromContext(req.Context()); tokenID != "" {
+		tok, err := s.getToken(tokenID)
+		if err != nil {
+			httpErrf(w, http.StatusInternalServerError, "looking up token: %s", err)
+			return
+		}
+		if err := s.checkAndRecordSpend(tok, rec.Collateral, rec.Asset.Address[:]); err != nil {
+			httpErrf(w, http.StatusBadRequest, "proposed collateral rejected: %s", err)
+			return
+		}
+	}
 
 	var (
 		clearRoot  [32]byte
 		cipherRoot [32]byte
 		key        [32]byte
-		assetID    = bc.HashFromBytes(rec.AssetID)
 	)
 	copy(clearRoot[:], rec.ClearRoot)
 	copy(cipherRoot[:], rec.CipherRoot)
 	copy(key[:], rec.Key)
 
-	now := time.Now()
-
-	prog, err := tredd.RevealKey(req.Context(), paymentProposal, s.seller, key, rec.Amount, assetID, s.o.r, s.signer, clearRoot, cipherRoot, now, rec.RevealDeadline, rec.RefundDeadline)
+	_, err = tredd.RevealKey(
+		req.Context(), s.client, s.seller, rec.ContractAddr,
+		key, rec.Asset, rec.Collateral,
+		clearRoot, cipherRoot, rec.RevealDeadline, rec.RefundDeadline,
+	)
 	if err != nil {
-		httpErrf(w, http.StatusBadRequest, "constructing reveal-key transaction: %s", err)
-		return
-	}
-
-	parsed := tredd.ParseLog(prog)
-	if parsed == nil {
-		httpErrf(w, http.StatusInternalServerError, "parsing tx log")
+		httpErrf(w, http.StatusBadRequest, "revealing key: %s", err)
 		return
 	}
 
-	rec.Anchor1 = parsed.Anchor1
-	rec.Anchor2 = parsed.Anchor2
-	rec.Buyer = parsed.Buyer
-	rec.OutputID = parsed.OutputID
-
-	err = s.storeRecord(rec)
-	if err != nil {
-		httpErrf(w, http.StatusInternalServerError, "updating transfer record")
+	if err := s.storeRecord(rec); err != nil {
+		httpErrf(w, http.StatusInternalServerError, "updating transfer record: %s", err)
 		return
 	}
 
-	vm, err := txvm.Validate(prog, 3, math.MaxInt64)
-	if err != nil {
-		httpErrf(w, http.StatusInternalServerError, "computing runlimit: %s", err)
+	if err := s.observer.Watch(rec.ContractAddr); err != nil {
+		httpErrf(w, http.StatusInternalServerError, "watching contract for claim events: %s", err)
 		return
 	}
 
-	s.queueClaimPaymentHelper(rec)
-
-	log.Printf("transfer %x: revealing key", transferID)
-
-	err = s.submitter(prog, 3, math.MaxInt64-vm.Runlimit())
-	if err != nil {
-		httpErrf(w, http.StatusInternalServerError, "submitting reveal-key transaction: %s", err)
-		return
-	}
+	log.Printf("transfer %x: revealed key for contract %s", transferID, rec.ContractAddr)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -372,40 +461,24 @@ func (s *server) getRecord(transferID []byte) (*serverRecord, error) {
 		if root == nil {
 			return errors.New("no root bucket")
 		}
-		recordsBucket := root.Bucket([]byte("records"))
-		if recordsBucket == nil {
+		records := root.Bucket([]byte("records"))
+		if records == nil {
 			return errors.New("no records bucket")
 		}
-		bu := recordsBucket.Bucket(transferID)
-		if bu == nil {
-			return fmt.Errorf("no record bucket %x", transferID)
+		buf := records.Get(transferID)
+		if buf == nil {
+			return fmt.Errorf("no record %x", transferID)
 		}
-		rec.Key = bu.Get([]byte("key"))
-		rec.ClearRoot = bu.Get([]byte("clearRoot"))
-		rec.CipherRoot = bu.Get([]byte("cipherRoot"))
-		rec.AssetID = bu.Get([]byte("assetID"))
-
-		var n int
-		rec.Amount, n = binary.Varint(bu.Get([]byte("amount")))
-		if n < 1 {
-			return fmt.Errorf("cannot parse amount in record %x", transferID)
-		}
-		revealDeadlineMS, n := binary.Uvarint(bu.Get([]byte("revealDeadlineMS")))
-		if n < 1 {
-			return fmt.Errorf("cannot parse reveal deadline in record %x", transferID)
-		}
-		rec.RevealDeadline = bc.FromMillis(revealDeadlineMS)
-		refundDeadlineMS, n := binary.Uvarint(bu.Get([]byte("refundDeadlineMS")))
-		if n < 1 {
-			return fmt.Errorf("cannot parse refund deadline in record %x", transferID)
-		}
-		rec.RefundDeadline = bc.FromMillis(refundDeadlineMS)
-		return nil
+		return json.Unmarshal(buf, &rec)
 	})
 	return &rec, err
 }
 
 func (s *server) storeRecord(rec *serverRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshaling transfer record")
+	}
 	return s.db.Update(func(tx *bbolt.Tx) error {
 		root, err := tx.CreateBucketIfNotExists([]byte("root"))
 		if err != nil {
@@ -415,141 +488,134 @@ func (s *server) storeRecord(rec *serverRecord) error {
 		if err != nil {
 			return errors.Wrap(err, "getting/creating records bucket")
 		}
-		bu, err := records.CreateBucketIfNotExists(rec.transferID[:])
-		if err != nil {
-			return errors.Wrapf(err, "creating record bucket %x", rec.transferID[:])
-		}
-
-		var amountBuf [binary.MaxVarintLen64]byte
-		m := binary.PutVarint(amountBuf[:], rec.Amount)
-		err = bu.Put([]byte("amount"), amountBuf[:m])
-		if err != nil {
-			return errors.Wrap(err, "storing amount")
-		}
-
-		err = bu.Put([]byte("assetID"), rec.AssetID)
-		if err != nil {
-			return errors.Wrap(err, "storing assetID")
-		}
-
-		err = bu.Put([]byte("anchor1"), rec.Anchor1)
-		if err != nil {
-			return errors.Wrap(err, "storing anchor1")
-		}
-
-		err = bu.Put([]byte("anchor2"), rec.Anchor2)
-		if err != nil {
-			return errors.Wrap(err, "storing anchor2")
-		}
+		return records.Put(rec.transferID[:], buf)
+	})
+}
 
-		err = bu.Put([]byte("clearRoot"), rec.ClearRoot)
-		if err != nil {
-			return errors.Wrap(err, "storing clearRoot")
-		}
+// chunkStoreFor returns the FileChunkStore for the content file at srcfile
+// with the given clearRoot, building it (and its <clearRoot>.chunks /
+// <clearRoot>.leaves sidecar files, alongside srcfile) on first use and
+// reusing it for every subsequent request for the same clearRoot.
+func (s *server) chunkStoreFor(srcfile string, clearRoot []byte) (*tredd.FileChunkStore, error) {
+	key := hex.EncodeToString(clearRoot)
 
-		err = bu.Put([]byte("cipherRoot"), rec.CipherRoot)
-		if err != nil {
-			return errors.Wrap(err, "storing cipherRoot")
-		}
+	s.chunkStoresMu.Lock()
+	defer s.chunkStoresMu.Unlock()
 
-		var revealDeadlineMSBuf [binary.MaxVarintLen64]byte
-		m = binary.PutUvarint(revealDeadlineMSBuf[:], bc.Millis(rec.RevealDeadline))
-		err = bu.Put([]byte("revealDeadlineMS"), revealDeadlineMSBuf[:m])
-		if err != nil {
-			return errors.Wrap(err, "storing reveal deadline")
-		}
-
-		var refundDeadlineMSBuf [binary.MaxVarintLen64]byte
-		m = binary.PutUvarint(refundDeadlineMSBuf[:], bc.Millis(rec.RefundDeadline))
-		err = bu.Put([]byte("refundDeadlineMS"), refundDeadlineMSBuf[:m])
-		if err != nil {
-			return errors.Wrap(err, "storing refund deadline")
-		}
+	if store, ok := s.chunkStores[key]; ok {
+		return store, nil
+	}
+	store, err := tredd.NewFileChunkStore(srcfile, srcfile+".chunks", srcfile+".leaves")
+	if err != nil {
+		return nil, errors.Wrapf(err, "building chunk store for %s", srcfile)
+	}
+	s.chunkStores[key] = store
+	return store, nil
+}
 
-		err = bu.Put([]byte("buyer"), rec.Buyer)
+// warmChunkStores walks s.dir at startup and builds a FileChunkStore for
+// every content file it finds, so that the first sale of each file is as
+// cheap as later ones.
+func (s *server) warmChunkStores() {
+	err := filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
 		if err != nil {
-			return errors.Wrap(err, "storing buyer")
+			return err
 		}
-
-		err = bu.Put([]byte("seller"), rec.Seller)
-		if err != nil {
-			return errors.Wrap(err, "storing seller")
+		if info.IsDir() || info.Name() == "content-type" || strings.HasSuffix(info.Name(), ".chunks") || strings.HasSuffix(info.Name(), ".leaves") {
+			return nil
 		}
-
-		err = bu.Put([]byte("key"), rec.Key)
+		clearRoot, err := clearRootOf(s.dir, p)
 		if err != nil {
-			return errors.Wrap(err, "storing key")
+			log.Printf("warming %s: %s", p, err)
+			return nil
 		}
-
-		err = bu.Put([]byte("outputID"), rec.OutputID)
-		if err != nil {
-			return errors.Wrap(err, "storing outputID")
+		if _, err := s.chunkStoreFor(p, clearRoot); err != nil {
+			log.Printf("warming %s: %s", p, err)
 		}
-
 		return nil
 	})
+	if err != nil {
+		log.Printf("warming chunk stores: %s", err)
+	}
 }
 
-func (s *server) queueClaimPayment(transferID []byte) error {
-	rec, err := s.getRecord(transferID)
+// clearHashPath returns the directory and filename under root at which the
+// content file for clearRoot is stored: a git-style two-level fan-out
+// (the hex hash's first two bytes as nested directories, the rest as the
+// filename) so a large content directory doesn't land every file in one
+// flat listing. clearRootOf reverses it.
+func clearHashPath(root string, clearRoot []byte) (dir, filename string) {
+	hexStr := hex.EncodeToString(clearRoot)
+	dir = filepath.Join(root, hexStr[:2], hexStr[2:4])
+	filename = hexStr[4:]
+	return dir, filename
+}
+
+// clearRootOf recovers the clear root hash of the content file at p,
+// which is stored (see clearHashPath) at a path derived from that hash's
+// hex encoding relative to root.
+func clearRootOf(root, p string) ([]byte, error) {
+	rel, err := filepath.Rel(root, p)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "computing relative path of %s", p)
 	}
-	s.queueClaimPaymentHelper(rec)
-	return nil
+	hexStr := strings.ReplaceAll(rel, string(filepath.Separator), "")
+	return hex.DecodeString(hexStr)
 }
 
-func (s *server) queueClaimPaymentHelper(rec *serverRecord) {
-	s.o.enqueue(rec.RefundDeadline, func() {
-		redeem := &tredd.Redeem{
-			RefundDeadline: rec.RefundDeadline,
-			Buyer:          rec.Buyer,
-			Seller:         s.seller,
-			Amount:         rec.Amount,
-			AssetID:        bc.HashFromBytes(rec.AssetID),
-		}
-		copy(redeem.Anchor2[:], rec.Anchor2)
-		copy(redeem.CipherRoot[:], rec.CipherRoot)
-		copy(redeem.ClearRoot[:], rec.ClearRoot)
-		copy(redeem.Key[:], rec.Key)
+// acceptTreddCipherHeader names the buyer header used to require a
+// specific chunk cipher ("aes-siv" or "xor-hash"); an unrecognized or
+// unsupported value is rejected rather than silently downgraded.
+const acceptTreddCipherHeader = "Accept-Tredd-Cipher"
+
+// negotiateCipher picks the ChunkCipher version to use for req, honoring
+// any Accept-Tredd-Cipher header the buyer sent. Absent a header, it
+// defaults to CipherXORHash for backwards compatibility with old buyers.
+func negotiateCipher(req *http.Request) (tredd.CipherVersion, error) {
+	want := req.Header.Get(acceptTreddCipherHeader)
+	if want == "" {
+		return tredd.CipherXORHash, nil
+	}
+	name := want
+	if idx := strings.Index(want, ";"); idx >= 0 {
+		name = want[:idx]
+	}
+	switch name {
+	case "aes-siv":
+		return tredd.CipherAESSIV, nil
+	case "xor-hash":
+		return tredd.CipherXORHash, nil
+	default:
+		return 0, fmt.Errorf("unsupported cipher %q", want)
+	}
+}
 
-		prog, err := tredd.ClaimPayment(redeem)
-		if err != nil {
-			log.Fatalf("constructing claim-payment transaction: %s", err)
-		}
-		vm, err := txvm.Validate(prog, 3, math.MaxInt64)
+// checkPrice rejects a proposed payment of the given amount in assetID
+// that falls short of this server's configured minimum for that asset, or
+// that would push tokenID over its daily spend cap, if it has one.
+// tokenID is "" when the request carries no access token.
+// TODO: per-content pricing, keyed also on clearRoot!
+func (s *server) checkPrice(amount int64, assetID []byte, clearRoot []byte, tokenID string) error {
+	min := int64(1)
+	if configured, ok := s.minPrices[hex.EncodeToString(assetID)]; ok {
+		min = configured
+	}
+	if amount < min {
+		return fmt.Errorf("amount %d is below the minimum price %d for asset %x", amount, min, assetID)
+	}
+	if tokenID != "" {
+		tok, err := s.getToken(tokenID)
 		if err != nil {
-			log.Fatalf("computing runlimit for claim-payment transaction: %s", err)
+			return errors.Wrap(err, "looking up token")
 		}
-		err = s.submitter(prog, 3, math.MaxInt64-vm.Runlimit())
-		if err != nil {
-			log.Fatalf("submitting claim-payment transaction: %s", err) // xxx this one should prob have a retry loop
-		}
-		err = s.db.Update(func(tx *bbolt.Tx) error {
-			root := tx.Bucket([]byte("root"))
-			if root == nil {
-				return errors.New("root bucket not found")
-			}
-			records := root.Bucket([]byte("records"))
-			if records == nil {
-				return errors.New("records bucket not found")
-			}
-			return records.DeleteBucket(rec.transferID[:])
-		})
-		if err != nil {
-			log.Printf("WARNING: could not delete transfer record %x: %s", rec.transferID[:], err)
+		if err := s.checkAndRecordSpend(tok, amount, assetID); err != nil {
+			return err
 		}
-	})
-}
-
-func (s *server) checkPrice(amount int64, assetID []byte, clearRoot []byte) error {
-	if amount > 0 { // TODO: per-content pricing!
-		return nil
 	}
-	return errors.New("amount must be 1 or higher")
+	return nil
 }
 
 func httpErrf(w http.ResponseWriter, code int, msgfmt string, args ...interface{}) {
 	http.Error(w, fmt.Sprintf(msgfmt, args...), code)
 	log.Printf(msgfmt, args...)
-}
\ No newline at end of file
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chain/txvm/errors"
+	"github.com/coreos/bbolt"
+)
+
+// tokenScope names an action an access token is permitted to perform.
+// It is inspired by bytom's blockchain/accesstokens package, trimmed to
+// the two things a Tredd buyer can do against this server.
+type tokenScope string
+
+const (
+	// scopeRequest allows browsing content: calling /request.
+	scopeRequest tokenScope = "request"
+
+	// scopeProposePayment allows spending: calling /propose-payment.
+	scopeProposePayment tokenScope = "propose-payment"
+)
+
+func (s tokenScope) valid() bool {
+	return s == scopeRequest || s == scopeProposePayment
+}
+
+// tokenRecord is a single row in the tokens bucket: an id, the salted hash
+// of its secret, the scopes it's allowed, when it was created, an optional
+// daily spend cap (0 meaning unlimited), and whether it's been revoked.
+type tokenRecord struct {
+	ID           string       `json:"id"`
+	Salt         []byte       `json:"salt"`
+	HashedSecret []byte       `json:"hashed_secret"`
+	Scopes       []tokenScope `json:"scopes"`
+	CreatedAt    time.Time    `json:"created_at"`
+	DailyCap     int64        `json:"daily_cap"` // max amount spendable per UTC day across all assets; 0 = unlimited
+	Revoked      bool         `json:"revoked"`
+}
+
+func (r *tokenRecord) hasScope(want tokenScope) bool {
+	for _, s := range r.Scopes {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+const tokensBucketName = "tokens"
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+func (s *server) putToken(rec *tokenRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshaling token record")
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(tokensBucketName))
+		if err != nil {
+			return errors.Wrap(err, "creating tokens bucket")
+		}
+		return bu.Put([]byte(rec.ID), buf)
+	})
+}
+
+func (s *server) getToken(id string) (*tokenRecord, error) {
+	var rec tokenRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(tokensBucketName))
+		if bu == nil {
+			return errors.New("no such token")
+		}
+		buf := bu.Get([]byte(id))
+		if buf == nil {
+			return errors.New("no such token")
+		}
+		return json.Unmarshal(buf, &rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// errAuthFailed is the one error authenticate ever returns for bad
+// credentials, whether the token id doesn't exist, is revoked, or the
+// secret is wrong. Distinguishing those cases in the response would let a
+// caller enumerate valid token ids by brute-forcing secrets and watching
+// which error text comes back.
+var errAuthFailed = errors.New("authentication failed")
+
+// authenticate extracts token credentials from req (HTTP Basic, or
+// Authorization: Bearer <id>:<secret>) and returns the corresponding
+// tokenRecord if it exists, is unrevoked, and the secret matches.
+func (s *server) authenticate(req *http.Request) (*tokenRecord, error) {
+	id, secret, err := tokenCredentials(req)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.getToken(id)
+	if err != nil {
+		return nil, errAuthFailed
+	}
+	if rec.Revoked {
+		return nil, errAuthFailed
+	}
+	want := hashSecret(rec.Salt, secret)
+	if subtle.ConstantTimeCompare(want, rec.HashedSecret) != 1 {
+		return nil, errAuthFailed
+	}
+	return rec, nil
+}
+
+func tokenCredentials(req *http.Request) (id, secret string, err error) {
+	if id, secret, ok := req.BasicAuth(); ok {
+		return id, secret, nil
+	}
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return "", "", errors.New("missing or unrecognized Authorization header")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(auth, prefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed bearer token, want <id>:<secret>")
+	}
+	return parts[0], parts[1], nil
+}
+
+type tokenIDContextKeyType struct{}
+
+var tokenIDContextKey tokenIDContextKeyType
+
+// requireScope wraps next so it only runs for requests bearing a valid,
+// unrevoked access token with the given scope. On success, the token's id
+// is attached to the request context (see tokenIDFromContext) so handlers
+// can use it for per-token pricing and spend tracking.
+func (s *server) requireScope(scope tokenScope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		rec, err := s.authenticate(req)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tredd"`)
+			httpErrf(w, http.StatusUnauthorized, "authenticating request: %s", err)
+			return
+		}
+		if !rec.hasScope(scope) {
+			httpErrf(w, http.StatusForbidden, "token %s lacks scope %s", rec.ID, scope)
+			return
+		}
+		ctx := context.WithValue(req.Context(), tokenIDContextKey, rec.ID)
+		next(w, req.WithContext(ctx))
+	}
+}
+
+func tokenIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(tokenIDContextKey).(string)
+	return id
+}
+
+// token dispatches the `tredd token create|list|revoke` subcommands.
+func token(args []string) {
+	if len(args) < 1 {
+		log.Fatal("usage: tredd token <create|list|revoke> ...")
+	}
+	switch args[0] {
+	case "create":
+		tokenCreateCmd(args[1:])
+	case "list":
+		tokenListCmd(args[1:])
+	case "revoke":
+		tokenRevokeCmd(args[1:])
+	default:
+		log.Fatalf("unknown token subcommand %q", args[0])
+	}
+}
+
+func tokenCreateCmd(args []string) {
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	var (
+		dbFile   = fs.String("db", "", "file containing server-state db")
+		scopes   = fs.String("scopes", string(scopeRequest), "comma-separated scopes: request, propose-payment")
+		dailyCap = fs.Int64("daily-cap", 0, "maximum amount this token may spend per UTC day (0 = unlimited)")
+	)
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	var rec tokenRecord
+	for _, s := range strings.Split(*scopes, ",") {
+		sc := tokenScope(strings.TrimSpace(s))
+		if !sc.valid() {
+			log.Fatalf("invalid scope %q", s)
+		}
+		rec.Scopes = append(rec.Scopes, sc)
+	}
+
+	var idBuf [8]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		log.Fatal(err)
+	}
+	rec.ID = hex.EncodeToString(idBuf[:])
+
+	var secretBuf [32]byte
+	if _, err := rand.Read(secretBuf[:]); err != nil {
+		log.Fatal(err)
+	}
+	secret := hex.EncodeToString(secretBuf[:])
+
+	rec.Salt = make([]byte, 16)
+	if _, err := rand.Read(rec.Salt); err != nil {
+		log.Fatal(err)
+	}
+	rec.HashedSecret = hashSecret(rec.Salt, secret)
+	rec.CreatedAt = time.Now()
+	rec.DailyCap = *dailyCap
+
+	db, err := bbolt.Open(*dbFile, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	s := &server{db: db}
+	if err := s.putToken(&rec); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("id:     %s\nsecret: %s\nscopes: %s\n", rec.ID, secret, *scopes)
+}
+
+func tokenListCmd(args []string) {
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	dbFile := fs.String("db", "", "file containing server-state db")
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	db, err := bbolt.Open(*dbFile, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		bu := tx.Bucket([]byte(tokensBucketName))
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(_, v []byte) error {
+			var rec tokenRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			fmt.Printf("%s\tscopes=%v\trevoked=%v\tdaily-cap=%d\tcreated=%s\n", rec.ID, rec.Scopes, rec.Revoked, rec.DailyCap, rec.CreatedAt.Format(time.RFC3339))
+			return nil
+		})
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func tokenRevokeCmd(args []string) {
+	fs := flag.NewFlagSet("", flag.PanicOnError)
+	var (
+		dbFile = fs.String("db", "", "file containing server-state db")
+		id     = fs.String("id", "", "id of the token to revoke")
+	)
+	if err := fs.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if *id == "" {
+		log.Fatal("missing -id")
+	}
+
+	db, err := bbolt.Open(*dbFile, 0600, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	s := &server{db: db}
+
+	rec, err := s.getToken(*id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rec.Revoked = true
+	if err := s.putToken(rec); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// spendKey returns the bbolt key tracking tokenID's spend for the UTC day
+// containing t, scoped to assetID so caps are enforced per asset.
+func spendKey(tokenID string, assetID []byte, t time.Time) []byte {
+	day := t.UTC().Format("2006-01-02")
+	return []byte(fmt.Sprintf("%s:%x:%s", tokenID, assetID, day))
+}
+
+const spendBucketName = "token_spend"
+
+// checkAndRecordSpend enforces tok's daily spend cap (if any) for assetID,
+// then records amount against it. It must only be called once the payment
+// proposal is otherwise accepted, since it's not rolled back on a later
+// failure.
+func (s *server) checkAndRecordSpend(tok *tokenRecord, amount int64, assetID []byte) error {
+	if tok.DailyCap <= 0 {
+		return nil
+	}
+	key := spendKey(tok.ID, assetID, time.Now())
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bu, err := tx.CreateBucketIfNotExists([]byte(spendBucketName))
+		if err != nil {
+			return errors.Wrap(err, "creating spend bucket")
+		}
+		var spent int64
+		if v := bu.Get(key); v != nil {
+			spent, _ = binary.Varint(v)
+		}
+		if spent+amount > tok.DailyCap {
+			return fmt.Errorf("token %s daily cap %d exceeded (already spent %d, requested %d)", tok.ID, tok.DailyCap, spent, amount)
+		}
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutVarint(buf[:], spent+amount)
+		return bu.Put(key, buf[:n])
+	})
+}
@@ -0,0 +1,76 @@
+// Package erc20 is a minimal Go binding for the ERC-20 token standard,
+// covering only the calls Tredd needs to move buyer payments and seller
+// collateral through a token contract instead of native ETH:
+// transfer, transferFrom, approve, allowance, and balanceOf.
+//
+// It is hand-trimmed from the shape that abigen produces (compare
+// wallet/erc20 in status-go), rather than generated from the full
+// ERC-20 ABI, so that this package has no build-time dependency on solc.
+package erc20
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// ABI is the subset of the ERC-20 interface that this package binds.
+const ABI = `[
+	{"constant":false,"inputs":[{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"type":"function"},
+	{"constant":false,"inputs":[{"name":"from","type":"address"},{"name":"to","type":"address"},{"name":"value","type":"uint256"}],"name":"transferFrom","outputs":[{"name":"","type":"bool"}],"type":"function"},
+	{"constant":false,"inputs":[{"name":"spender","type":"address"},{"name":"value","type":"uint256"}],"name":"approve","outputs":[{"name":"","type":"bool"}],"type":"function"},
+	{"constant":true,"inputs":[{"name":"owner","type":"address"},{"name":"spender","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"type":"function"},
+	{"constant":true,"inputs":[{"name":"owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"type":"function"}
+]`
+
+// Token is a binding for a deployed ERC-20 contract.
+type Token struct {
+	contract *bind.BoundContract
+}
+
+// New creates a Token binding for the contract at addr.
+func New(addr common.Address, backend bind.ContractBackend) (*Token, error) {
+	parsed, err := abi.JSON(strings.NewReader(ABI))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing ERC-20 ABI")
+	}
+	return &Token{contract: bind.NewBoundContract(addr, parsed, backend, backend, backend)}, nil
+}
+
+// BalanceOf returns owner's token balance.
+func (t *Token) BalanceOf(opts *bind.CallOpts, owner common.Address) (*big.Int, error) {
+	var out *big.Int
+	err := t.contract.Call(opts, &[]interface{}{&out}, "balanceOf", owner)
+	return out, errors.Wrap(err, "calling balanceOf")
+}
+
+// Allowance returns the amount spender is still allowed to draw from owner.
+func (t *Token) Allowance(opts *bind.CallOpts, owner, spender common.Address) (*big.Int, error) {
+	var out *big.Int
+	err := t.contract.Call(opts, &[]interface{}{&out}, "allowance", owner, spender)
+	return out, errors.Wrap(err, "calling allowance")
+}
+
+// Approve authorizes spender to transfer up to value tokens from the caller's balance.
+func (t *Token) Approve(opts *bind.TransactOpts, spender common.Address, value *big.Int) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "approve", spender, value)
+	return tx, errors.Wrap(err, "calling approve")
+}
+
+// Transfer moves value tokens from the caller's balance to to.
+func (t *Token) Transfer(opts *bind.TransactOpts, to common.Address, value *big.Int) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "transfer", to, value)
+	return tx, errors.Wrap(err, "calling transfer")
+}
+
+// TransferFrom moves value tokens from from's balance to to, spending
+// an existing allowance previously granted via Approve.
+func (t *Token) TransferFrom(opts *bind.TransactOpts, from, to common.Address, value *big.Int) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "transferFrom", from, to, value)
+	return tx, errors.Wrap(err, "calling transferFrom")
+}
@@ -0,0 +1,128 @@
+package tredd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/bobg/merkle"
+	"github.com/chain/txvm/errors"
+)
+
+// Receive is the counterpart to Serve: it reads a stream Serve (or
+// ServeFromStore) produced, decrypting each chunk with cipher and writing
+// the cleartext to w. It returns the Merkle roots of the cleartext and
+// ciphertext chunks it saw, computed the same way Serve computes
+// cipherRoot, so a caller can compare them against the clearRoot and
+// cipherRoot committed to on-chain before trusting w's contents.
+//
+// Receive itself does not treat a root mismatch as fatal: it still
+// returns the roots it computed, leaving the decision of what to do about
+// a mismatch (such as assembling a ClaimRefund) to the caller.
+func Receive(w io.Writer, r io.Reader, cipher ChunkCipher) (clearRoot, cipherRoot []byte, err error) {
+	clearMT := merkle.NewTree(sha256.New())
+
+	cipherRoot, err = scanCipherstream(r, cipher.Version(), cipher.Overhead(), func(index uint64, clearHash [32]byte, cipherChunk []byte) error {
+		clear, err := cipher.Open(nil, cipherChunk, index)
+		if err != nil {
+			return errors.Wrapf(err, "decrypting chunk %d", index)
+		}
+		if !bytes.Equal(merkle.LeafHash(sha256.New(), nil, clear), clearHash[:]) {
+			return &ChunkMismatchError{Index: index, CipherChunk: cipherChunk, ClearHash: clearHash}
+		}
+		if _, err := w.Write(clear); err != nil {
+			return errors.Wrapf(err, "writing clear chunk %d", index)
+		}
+		clearMT.Add(clear)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return clearMT.Root(), cipherRoot, nil
+}
+
+// ErrCipherMismatch is returned by Receive when the stream's cipher
+// version byte doesn't match the ChunkCipher the caller supplied.
+var ErrCipherMismatch = errors.New("cipher version mismatch")
+
+// ChunkMismatchError is returned by Receive when a decrypted chunk's hash
+// doesn't match the clear hash recorded for it on the wire. It carries
+// what a caller needs to dispute the chunk on-chain (see ClaimRefund):
+// the chunk's index, its still-encrypted bytes, and the hash it was
+// committed to.
+type ChunkMismatchError struct {
+	Index       uint64
+	CipherChunk []byte
+	ClearHash   [32]byte
+}
+
+func (e *ChunkMismatchError) Error() string {
+	return fmt.Sprintf("chunk %d: decrypted cleartext does not match its committed hash", e.Index)
+}
+
+// CipherRootOf computes the Merkle root over a Serve stream's ciphertext
+// chunks without decrypting them, using only the cipher's version and its
+// (key-independent) Overhead. A buyer uses this to recover the
+// cipherRoot it must pass to ProposePayment immediately after fetching a
+// cipherstream, before the seller has revealed the decryption key.
+func CipherRootOf(r io.Reader, version CipherVersion) ([]byte, error) {
+	probe, err := NewChunkCipher(version, [32]byte{})
+	if err != nil {
+		return nil, errors.Wrap(err, "building cipher")
+	}
+	return scanCipherstream(r, version, probe.Overhead(), nil)
+}
+
+// scanCipherstream reads a Serve wire stream's version byte and its
+// sequence of (clear hash, cipher chunk) pairs, feeding each pair to
+// onChunk (if given) and folding the cipher chunk into a Merkle tree the
+// same way Serve computes cipherRoot. Receive uses onChunk to decrypt and
+// verify each chunk as it goes; CipherRootOf passes a nil onChunk to just
+// compute the root.
+func scanCipherstream(r io.Reader, version CipherVersion, overhead int, onChunk func(index uint64, clearHash [32]byte, cipherChunk []byte) error) ([]byte, error) {
+	var versionByte [1]byte
+	if _, err := io.ReadFull(r, versionByte[:]); err != nil {
+		return nil, errors.Wrap(err, "reading cipher version")
+	}
+	if CipherVersion(versionByte[0]) != version {
+		return nil, errors.Wrapf(ErrCipherMismatch, "stream is version %d, expected %d", versionByte[0], version)
+	}
+
+	var (
+		cipherMT    = merkle.NewTree(sha256.New())
+		cipherChunk = make([]byte, ChunkSize+overhead)
+	)
+
+	for index := uint64(0); ; index++ {
+		var clearHash [32]byte
+		_, err := io.ReadFull(r, clearHash[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading clear hash %d", index)
+		}
+
+		n, err := io.ReadFull(r, cipherChunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, errors.Wrapf(err, "reading cipher chunk %d", index)
+		}
+
+		var prefix [1 + binary.MaxVarintLen64]byte
+		prefix[0] = versionByte[0]
+		m := 1 + binary.PutUvarint(prefix[1:], index)
+		leaf := append(append([]byte(nil), prefix[:m]...), cipherChunk[:n]...)
+		cipherMT.Add(leaf)
+
+		if onChunk != nil {
+			if err := onChunk(index, clearHash, cipherChunk[:n]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return cipherMT.Root(), nil
+}
@@ -1,4 +1,4 @@
-package tedd
+package tredd
 
 import (
 	"crypto/sha256"
@@ -9,23 +9,37 @@ import (
 	"github.com/chain/txvm/errors"
 )
 
-// Serve produces a stream of interleaved <clearhash><cipherchunk> pairs from the content in r.
-// It writes the stream to w, encrypting the chunks by xoring with hashes derived from key.
-// The return value is the Merkle root hash of the cipher chunks, each prepended with its chunk index.
-// TODO: Cleartext chunks and their hashes can be precomputed and supplied as ChunkStores.
-func Serve(w io.Writer, r io.Reader, key [32]byte) ([]byte, error) {
+// ChunkSize is the number of cleartext bytes Serve/Receive read, encrypt,
+// and commit to per chunk; a stream's final chunk may be shorter. It's a
+// fixed package constant (rather than, say, a Serve parameter) because
+// both sides of a transfer - and any ChunkMismatchError proof - have to
+// agree on chunk boundaries without negotiating them out of band.
+const ChunkSize = 64 * 1024
+
+// Serve produces a stream of <cipher version byte><interleaved clearhash,cipherchunk pairs>
+// from the content in r, encrypting chunks with cipher.
+// The return value is the Merkle root hash of the cipher chunks,
+// each committed to as version||index||ciphertext so a downgrade to a
+// weaker cipher after the fact would change the root.
+// Callers that already have precomputed cleartext chunks and leaf hashes
+// (e.g. from a FileChunkStore) should use ServeFromStore instead,
+// which skips the cost of rereading and rehashing the source.
+func Serve(w io.Writer, r io.Reader, cipher ChunkCipher) ([]byte, error) {
+	if _, err := w.Write([]byte{byte(cipher.Version())}); err != nil {
+		return nil, errors.Wrap(err, "writing cipher version")
+	}
+
 	var (
 		cipherMT            = merkle.NewTree(sha256.New())
 		hasher              = sha256.New()
-		chunkWithPrefix     [ChunkSize + binary.MaxVarintLen64]byte
+		clearChunk          [ChunkSize]byte
 		clearHashWithPrefix [32 + binary.MaxVarintLen64]byte
 	)
 
 	for index := uint64(0); ; index++ {
-		m := binary.PutUvarint(chunkWithPrefix[:], index)
-		binary.PutUvarint(clearHashWithPrefix[:], index)
+		m := binary.PutUvarint(clearHashWithPrefix[:], index)
 
-		n, err := io.ReadFull(r, chunkWithPrefix[m:m+ChunkSize])
+		n, err := io.ReadFull(r, clearChunk[:])
 		if err == io.EOF {
 			// "The error is EOF only if no bytes were read."
 			break
@@ -34,20 +48,77 @@ func Serve(w io.Writer, r io.Reader, key [32]byte) ([]byte, error) {
 			return nil, errors.Wrapf(err, "reading clear chunk %d", index)
 		}
 
-		merkle.LeafHash(hasher, clearHashWithPrefix[:m], chunkWithPrefix[:m+n])
+		merkle.LeafHash(hasher, clearHashWithPrefix[:m], clearChunk[:n])
 
 		_, err = w.Write(clearHashWithPrefix[m : m+32])
 		if err != nil {
 			return nil, errors.Wrapf(err, "writing clear hash %d", index)
 		}
 
-		crypt(key, chunkWithPrefix[m:m+n], index) // n.b. overwrites the contents of chunk
-		_, err = w.Write(chunkWithPrefix[m : m+n])
+		leaf, cipherChunk, err := sealChunk(cipher, index, clearChunk[:n])
+		if err != nil {
+			return nil, errors.Wrapf(err, "encrypting chunk %d", index)
+		}
+		_, err = w.Write(cipherChunk)
 		if err != nil {
 			return nil, errors.Wrapf(err, "writing cipher chunk %d", index)
 		}
-		cipherMT.Add(chunkWithPrefix[:m+n])
+		cipherMT.Add(leaf)
 	}
 
 	return cipherMT.Root(), nil
 }
+
+// ServeFromStore is like Serve but takes its cleartext chunks and their leaf
+// hashes from store instead of reading and hashing them from an io.Reader.
+// This skips the cost of rereading and rehashing the plaintext on every
+// request; only the per-request encryption and cipher-Merkle-tree
+// computation remain.
+func ServeFromStore(w io.Writer, store ChunkStore, cipher ChunkCipher) ([]byte, error) {
+	if _, err := w.Write([]byte{byte(cipher.Version())}); err != nil {
+		return nil, errors.Wrap(err, "writing cipher version")
+	}
+
+	cipherMT := merkle.NewTree(sha256.New())
+
+	for index := 0; index < store.Len(); index++ {
+		chunk, leafHash, err := store.ChunkAndLeafHash(index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting chunk %d", index)
+		}
+
+		_, err = w.Write(leafHash[:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "writing clear hash %d", index)
+		}
+
+		leaf, cipherChunk, err := sealChunk(cipher, uint64(index), chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encrypting chunk %d", index)
+		}
+		_, err = w.Write(cipherChunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "writing cipher chunk %d", index)
+		}
+		cipherMT.Add(leaf)
+	}
+
+	return cipherMT.Root(), nil
+}
+
+// sealChunk encrypts the cleartext chunk at index with cipher, returning
+// both the full Merkle-leaf input (version||index||ciphertext) and the
+// ciphertext portion of it alone (for writing to the wire).
+func sealChunk(cipher ChunkCipher, index uint64, cleartext []byte) (leaf, cipherChunk []byte, err error) {
+	var prefix [1 + binary.MaxVarintLen64]byte
+	prefix[0] = byte(cipher.Version())
+	m := 1 + binary.PutUvarint(prefix[1:], index)
+
+	buf := make([]byte, m, m+len(cleartext)+cipher.Overhead())
+	copy(buf, prefix[:m])
+	buf, err = cipher.Seal(buf, cleartext, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, buf[m:], nil
+}
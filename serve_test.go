@@ -0,0 +1,97 @@
+package tredd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bobg/merkle"
+)
+
+// TestServeConformance streams every vector under testvectors/ through
+// Serve and checks the output byte-for-byte against the recorded stream,
+// along with both Merkle roots. It's the counterpart to the "gen-vectors"
+// subcommand in cmd/tredd, which produces those files in the first place;
+// run it whenever Serve, a ChunkCipher, or the wire format changes, to
+// confirm the change was intentional.
+func TestServeConformance(t *testing.T) {
+	paths, err := filepath.Glob("testvectors/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no files in testvectors/; run `tredd gen-vectors` to generate them")
+	}
+
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var vs VectorSet
+			if err := json.Unmarshal(buf, &vs); err != nil {
+				t.Fatalf("unmarshaling %s: %s", path, err)
+			}
+
+			keyBytes, err := hex.DecodeString(vs.Key)
+			if err != nil || len(keyBytes) != 32 {
+				t.Fatalf("bad key in %s", path)
+			}
+			var key [32]byte
+			copy(key[:], keyBytes)
+
+			var (
+				clear   []byte
+				wantStr bytes.Buffer
+				clearMT = merkle.NewTree(sha256.New())
+			)
+			wantStr.WriteByte(byte(vs.Version))
+			for i, c := range vs.Chunks {
+				clearChunk, err := hex.DecodeString(c.ClearHex)
+				if err != nil {
+					t.Fatalf("chunk %d: bad clear_hex: %s", i, err)
+				}
+				leafHash, err := hex.DecodeString(c.ClearLeafHex)
+				if err != nil {
+					t.Fatalf("chunk %d: bad clear_leaf_hex: %s", i, err)
+				}
+				cipherChunk, err := hex.DecodeString(c.CipherHex)
+				if err != nil {
+					t.Fatalf("chunk %d: bad cipher_hex: %s", i, err)
+				}
+
+				clear = append(clear, clearChunk...)
+				clearMT.Add(clearChunk)
+				wantStr.Write(leafHash)
+				wantStr.Write(cipherChunk)
+			}
+
+			if got := hex.EncodeToString(clearMT.Root()); got != vs.ClearRoot {
+				t.Errorf("clear root = %s, want %s", got, vs.ClearRoot)
+			}
+
+			cipher, err := NewChunkCipher(vs.Version, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			cipherRoot, err := Serve(&got, bytes.NewReader(clear), cipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got.Bytes(), wantStr.Bytes()) {
+				t.Errorf("Serve output does not match recorded vector")
+			}
+			if gotRoot := hex.EncodeToString(cipherRoot); gotRoot != vs.CipherRoot {
+				t.Errorf("cipher root = %s, want %s", gotRoot, vs.CipherRoot)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package tredd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/bobg/merkle"
+	"github.com/chain/txvm/errors"
+)
+
+// Vector is one chunk's worth of data in a VectorSet: its cleartext, the
+// ciphertext Serve produces for it, and the Merkle leaf hash Serve writes
+// to the wire ahead of that ciphertext.
+type Vector struct {
+	ClearHex     string `json:"clear_hex"`
+	CipherHex    string `json:"cipher_hex"`
+	ClearLeafHex string `json:"clear_leaf_hex"`
+}
+
+// VectorSet is the schema for a committed Serve conformance test vector:
+// enough information for an implementation of the wire format in any
+// language to check itself against this Go implementation's canonical
+// output, without having to link against this package.
+type VectorSet struct {
+	Name       string        `json:"name"`
+	Key        string        `json:"key"`     // hex, 32 bytes
+	Version    CipherVersion `json:"version"` // ChunkCipher version used to produce Chunks
+	ChunkSize  int           `json:"chunk_size"`
+	Chunks     []Vector      `json:"chunks"`
+	ClearRoot  string        `json:"clear_root"`  // hex; Merkle root over the cleartext chunks
+	CipherRoot string        `json:"cipher_root"` // hex; the root Serve returns
+}
+
+// GenerateVectorSet runs content through the same per-chunk hashing and
+// encryption Serve performs, recording every intermediate value needed to
+// reproduce and check Serve's output independently. name identifies the
+// edge case the vector covers (e.g. "empty-zero-key") and becomes its
+// corpus filename; see cmd/tredd's "gen-vectors" subcommand.
+func GenerateVectorSet(name string, content []byte, key [32]byte, version CipherVersion) (*VectorSet, error) {
+	cipher, err := NewChunkCipher(version, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "building cipher")
+	}
+
+	var (
+		clearMT  = merkle.NewTree(sha256.New())
+		cipherMT = merkle.NewTree(sha256.New())
+		hasher   = sha256.New()
+		chunks   []Vector
+	)
+
+	for start := 0; start < len(content); start += ChunkSize {
+		index := start / ChunkSize
+		end := start + ChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		clear := content[start:end]
+
+		leafHash := merkle.LeafHash(hasher, nil, clear)
+		clearMT.Add(clear)
+
+		leaf, cipherChunk, err := sealChunk(cipher, uint64(index), clear)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sealing chunk %d", index)
+		}
+		cipherMT.Add(leaf)
+
+		chunks = append(chunks, Vector{
+			ClearHex:     hex.EncodeToString(clear),
+			CipherHex:    hex.EncodeToString(cipherChunk),
+			ClearLeafHex: hex.EncodeToString(leafHash),
+		})
+	}
+
+	return &VectorSet{
+		Name:       name,
+		Key:        hex.EncodeToString(key[:]),
+		Version:    version,
+		ChunkSize:  ChunkSize,
+		Chunks:     chunks,
+		ClearRoot:  hex.EncodeToString(clearMT.Root()),
+		CipherRoot: hex.EncodeToString(cipherMT.Root()),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package tredd
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// TreddABI is the ABI of the Tredd escrow contract (see
+// contracts/Tredd.sol), hand-trimmed to the constructor, methods, and
+// events tx.go drives, in the same style as erc20.ABI.
+const TreddABI = `[
+	{"inputs":[{"name":"seller_","type":"address"},{"name":"asset_","type":"address"},{"name":"amount_","type":"uint256"},{"name":"collateral_","type":"uint256"},{"name":"clearRoot_","type":"bytes32"},{"name":"cipherRoot_","type":"bytes32"},{"name":"cipherVersion_","type":"uint8"},{"name":"revealDeadline_","type":"uint256"},{"name":"refundDeadline_","type":"uint256"}],"payable":true,"stateMutability":"payable","type":"constructor"},
+	{"constant":true,"inputs":[],"name":"key","outputs":[{"name":"","type":"bytes32"}],"payable":false,"stateMutability":"view","type":"function"},
+	{"constant":false,"inputs":[{"name":"key_","type":"bytes32"}],"name":"reveal","outputs":[],"payable":true,"stateMutability":"payable","type":"function"},
+	{"constant":false,"inputs":[],"name":"claimPayment","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"},
+	{"constant":false,"inputs":[{"name":"index","type":"uint256"},{"name":"version","type":"uint8"},{"name":"cipherChunk","type":"bytes"},{"name":"clearHash","type":"bytes32"},{"name":"cipherProof","type":"bytes"},{"name":"clearProof","type":"bytes"}],"name":"refund","outputs":[],"payable":false,"stateMutability":"nonpayable","type":"function"},
+	{"anonymous":false,"inputs":[{"indexed":true,"name":"buyer","type":"address"},{"indexed":true,"name":"seller","type":"address"},{"indexed":false,"name":"amount","type":"uint256"},{"indexed":false,"name":"collateral","type":"uint256"}],"name":"TreddCreated","type":"event"},
+	{"anonymous":false,"inputs":[{"indexed":false,"name":"key","type":"bytes32"}],"name":"TreddReveal","type":"event"},
+	{"anonymous":false,"inputs":[{"indexed":true,"name":"seller","type":"address"},{"indexed":false,"name":"amount","type":"uint256"},{"indexed":false,"name":"collateral","type":"uint256"}],"name":"TreddPayment","type":"event"},
+	{"anonymous":false,"inputs":[{"indexed":true,"name":"buyer","type":"address"},{"indexed":false,"name":"amount","type":"uint256"},{"indexed":false,"name":"collateral","type":"uint256"}],"name":"TreddRefund","type":"event"}
+]`
+
+// TreddBin is the Tredd contract's deployment bytecode, produced by
+// compiling contracts/Tredd.sol with solc. This repo has no solc build
+// step (see erc20.ABI's doc comment for the same no-generated-binding
+// approach on the consuming side), so there is no bytecode to check in
+// here; ProposePayment's bind.DeployContract call will fail against this
+// empty value until a real build produces one.
+const TreddBin = ""
+
+// Tredd is a binding for a deployed Tredd contract.
+type Tredd struct {
+	contract *bind.BoundContract
+}
+
+// NewTredd creates a Tredd binding for the contract at addr.
+func NewTredd(addr common.Address, backend bind.ContractBackend) (*Tredd, error) {
+	parsed, err := abi.JSON(strings.NewReader(TreddABI))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Tredd ABI")
+	}
+	return &Tredd{contract: bind.NewBoundContract(addr, parsed, backend, backend, backend)}, nil
+}
+
+// Key returns the decryption key the seller has revealed, or the zero
+// value if Reveal hasn't been called yet.
+func (t *Tredd) Key(opts *bind.CallOpts) ([32]byte, error) {
+	var out [32]byte
+	err := t.contract.Call(opts, &[]interface{}{&out}, "key")
+	return out, errors.Wrap(err, "calling key")
+}
+
+// Reveal posts the seller's collateral and records key as the revealed
+// decryption key.
+func (t *Tredd) Reveal(opts *bind.TransactOpts, key [32]byte) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "reveal", key)
+	return tx, errors.Wrap(err, "calling reveal")
+}
+
+// ClaimPayment pays the seller the buyer's payment plus its own
+// collateral back, once the key has been revealed.
+func (t *Tredd) ClaimPayment(opts *bind.TransactOpts) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "claimPayment")
+	return tx, errors.Wrap(err, "calling claimPayment")
+}
+
+// Refund pays the buyer back its payment plus the seller's collateral,
+// disputing the chunk at index with the given proofs and cipher version
+// (see contracts/Tredd.sol's refund for what each proof establishes).
+func (t *Tredd) Refund(opts *bind.TransactOpts, index *big.Int, version uint8, cipherChunk []byte, clearHash [32]byte, cipherProof, clearProof []byte) (*types.Transaction, error) {
+	tx, err := t.contract.Transact(opts, "refund", index, version, cipherChunk, clearHash, cipherProof, clearProof)
+	return tx, errors.Wrap(err, "calling refund")
+}
@@ -18,15 +18,19 @@ import (
 )
 
 // ProposePayment publishes a new instance of the Tredd contract instantiated with the given parameters.
+// If asset is not native ETH, the buyer's allowance for the deployed contract must cover amount;
+// ProposePayment approves it first if the buyer hasn't already done so. If asset is native ETH,
+// the deployment transaction itself carries amount as its value, per the contract's constructor.
 func ProposePayment(
 	ctx context.Context,
 	client *ethclient.Client, // see ethclient.Dial
 	buyer *bind.TransactOpts, // see bind.NewTransactor
 	seller common.Address,
 	amount int64,
-	tokenType []byte, // TODO: how to specify the token type?
+	asset TokenAsset,
 	collateral int64,
 	clearRoot, cipherRoot [32]byte,
+	cipherVersion CipherVersion,
 	revealDeadline, refundDeadline time.Time,
 ) (*types.Receipt, error) {
 	parsed, err := abi.JSON(strings.NewReader(TreddABI))
@@ -34,11 +38,28 @@ func ProposePayment(
 		return nil, errors.Wrap(err, "parsing contract JSON to ABI")
 	}
 
-	_, tx, _, err := bind.DeployContract(buyer, parsed, common.FromHex(TreddBin), client)
+	txOpts := *buyer
+	if asset.IsNative() {
+		txOpts.Value = big.NewInt(amount)
+	}
+
+	contractAddr, tx, _, err := bind.DeployContract(
+		&txOpts, parsed, common.FromHex(TreddBin), client,
+		seller, asset.Address, big.NewInt(amount), big.NewInt(collateral),
+		clearRoot, cipherRoot, uint8(cipherVersion),
+		big.NewInt(revealDeadline.Unix()), big.NewInt(refundDeadline.Unix()),
+	)
 	if err != nil {
 		return nil, errors.Wrap(err, "deploying contract")
 	}
 
+	if !asset.IsNative() {
+		err = asset.EnsureAllowance(ctx, client, buyer, contractAddr, amount)
+		if err != nil {
+			return nil, errors.Wrap(err, "approving buyer allowance")
+		}
+	}
+
 	// Wait for tx to be mined on-chain.
 	receipt, err := bind.WaitMined(ctx, client, tx)
 	if err != nil {
@@ -51,21 +72,32 @@ func ProposePayment(
 }
 
 // RevealKey updates a Tredd contract on-chain by adding the decryption key.
-// TODO: Must also supply collateral.
+// If asset is not native ETH, the seller's collateral allowance for the
+// contract must cover collateral; RevealKey approves it first if needed.
+// TODO: read values from the on-chain contract, verify they match the "want" parameters
 func RevealKey(
 	ctx context.Context,
 	client *ethclient.Client, // see ethclient.Dial
 	seller *bind.TransactOpts, // see bind.NewTransactor
 	contractAddr common.Address,
 	key [32]byte,
+	asset TokenAsset,
+	collateral int64,
 	wantClearRoot, wantCipherRoot [32]byte,
 	wantRevealDeadline, wantRefundDeadline time.Time,
 ) (*types.Receipt, error) {
-	// TODO: read values from the on-chain contract, verify they match the "want" parameters
 	con, err := NewTredd(contractAddr, client)
 	if err != nil {
 		return nil, errors.Wrap(err, "instantiating deployed contract")
 	}
+
+	if !asset.IsNative() {
+		err = asset.EnsureAllowance(ctx, client, seller, contractAddr, collateral)
+		if err != nil {
+			return nil, errors.Wrap(err, "approving seller collateral allowance")
+		}
+	}
+
 	tx, err := con.Reveal(seller, key)
 	if err != nil {
 		return nil, errors.Wrap(err, "invoking ClaimPayment")
@@ -95,12 +127,19 @@ func ClaimPayment(
 // ClaimRefund constructs a buyer-claims-refund transaction,
 // rehydrating a Tredd contract from the utxo state (identified by the information in r)
 // and calling it with the necessary proofs and other information.
+//
+// version identifies which ChunkCipher produced cipherChunk. The contract
+// commits to a cipher version alongside cipherRoot at propose-payment time
+// (see ProposePayment) and checks version against that commitment before
+// accepting the dispute, so a seller can't dodge a refund by re-serving the
+// same content under a weaker cipher than the one the buyer paid for.
 func ClaimRefund(
 	ctx context.Context,
 	client *ethclient.Client,
 	buyer *bind.TransactOpts,
 	contractAddr common.Address,
 	index int64,
+	version CipherVersion,
 	cipherChunk []byte,
 	clearHash [32]byte,
 	cipherProof, clearProof []byte, // TODO: determine the right representation for merkle proofs in Solidity
@@ -112,7 +151,7 @@ func ClaimRefund(
 
 	bigIndex := big.NewInt(index)
 
-	tx, err := con.Refund(buyer, bigIndex, cipherChunk, clearHash, cipherProof, clearProof)
+	tx, err := con.Refund(buyer, bigIndex, uint8(version), cipherChunk, clearHash, cipherProof, clearProof)
 	if err != nil {
 		return nil, errors.Wrap(err, "invoking Refund")
 	}